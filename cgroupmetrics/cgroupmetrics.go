@@ -0,0 +1,481 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package cgroupmetrics publishes the container resource limits and usage
+// of the process's cgroup (v1 or v2) to circonus-gometrics.
+package cgroupmetrics
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPrefix     = "container"
+	defaultProcPath   = "/proc"
+	defaultCgroupPath = "/sys/fs/cgroup"
+
+	// v1 reports no memory limit as a very large value (page aligned max int64)
+	unlimitedV1 = uint64(1) << 62
+)
+
+// Options for the cgroup metrics collector
+type Options struct {
+	// Prefix for metric names, default "container". The prefix also names
+	// the collector.
+	Prefix string
+
+	// ProcPath is the mount point of procfs, default "/proc"
+	ProcPath string
+
+	// CgroupPath is the mount point of the cgroup filesystem(s), default "/sys/fs/cgroup"
+	CgroupPath string
+
+	// Tags for the cgroup metrics, e.g. the pod or container name
+	Tags cgm.Tags
+}
+
+// Metrics published (each tagged with the Options.Tags), limits are 0 if unlimited:
+//
+//   <prefix>_cpu_quota_cores               gauge, cpu quota / period
+//   <prefix>_cpu_usage_seconds             gauge, total cpu time
+//   <prefix>_cpu_periods                   counter, enforcement periods
+//   <prefix>_cpu_throttled_periods         counter, periods throttled
+//   <prefix>_cpu_throttled_seconds         gauge, total time throttled
+//   <prefix>_memory_limit_bytes            gauge
+//   <prefix>_memory_usage_bytes            gauge
+//   <prefix>_memory_working_set_bytes      gauge, usage less inactive file cache
+//   <prefix>_memory_oom_kills              counter
+//   <prefix>_pids_limit                    gauge
+//   <prefix>_pids_current                  gauge
+//
+// Only the metrics which could be read are published, e.g. the pids metrics
+// are not published if the pids controller is not enabled.
+
+// stat identifies a statistic of a sample
+type stat uint
+
+const (
+	statCPUQuota stat = 1 << iota
+	statCPUUsage
+	statCPUPeriods
+	statCPUThrottled
+	statCPUThrottledTime
+	statMemoryLimit
+	statMemoryUsage
+	statMemoryInactiveFile
+	statMemoryOOMKills
+	statPidsLimit
+	statPidsCurrent
+)
+
+// sample holds the cgroup statistics
+type sample struct {
+	read stat // statistics read
+
+	cpuQuota           float64 // cores
+	cpuUsage           float64 // seconds
+	cpuPeriods         uint64
+	cpuThrottled       uint64
+	cpuThrottledTime   float64 // seconds
+	memoryLimit        uint64
+	memoryUsage        uint64
+	memoryInactiveFile uint64
+	memoryOOMKills     uint64
+	pidsLimit          uint64
+	pidsCurrent        uint64
+}
+
+// has returns whether all of the statistics were read
+func (s sample) has(st stat) bool {
+	return s.read&st == st
+}
+
+// workingSet returns memory usage less the inactive file cache
+func (s sample) workingSet() uint64 {
+	if s.memoryInactiveFile > s.memoryUsage {
+		return 0
+	}
+	return s.memoryUsage - s.memoryInactiveFile
+}
+
+// cgroup is the discovered cgroup of the process, the directories of the
+// controllers (the same directory for v2)
+type cgroup struct {
+	version int
+	cpu     string
+	cpuacct string
+	memory  string
+	pids    string
+}
+
+// collector reads the cgroup statistics at each flush
+type collector struct {
+	prefix string
+	cg     *cgroup
+	tags   cgm.Tags
+}
+
+// Register registers a collector publishing the cgroup metrics at each flush,
+// an error is returned if the process's cgroup cannot be discovered.
+func Register(m *cgm.CirconusMetrics, opts *Options) error {
+	o := options(opts)
+
+	cg, err := discover(o.ProcPath, o.CgroupPath)
+	if err != nil {
+		return err
+	}
+
+	m.RegisterCollector(o.Prefix, &collector{prefix: o.Prefix + "_", cg: cg, tags: o.Tags}, 0)
+
+	return nil
+}
+
+// Unregister stops publishing the cgroup metrics registered with the same Prefix.
+func Unregister(m *cgm.CirconusMetrics, opts *Options) {
+	o := options(opts)
+	m.UnregisterCollector(o.Prefix)
+}
+
+// Collect implements cgm.Collector
+func (c *collector) Collect(ctx context.Context, e *cgm.Emitter) error {
+	s := c.cg.read()
+	if s.read == 0 {
+		return errors.New("reading cgroup: no statistics available")
+	}
+
+	p := c.prefix
+	if s.has(statCPUQuota) {
+		e.SetGauge(p+"cpu_quota_cores", c.tags, s.cpuQuota)
+	}
+	if s.has(statCPUUsage) {
+		e.SetGauge(p+"cpu_usage_seconds", c.tags, s.cpuUsage)
+	}
+	if s.has(statCPUPeriods) {
+		e.Set(p+"cpu_periods", c.tags, s.cpuPeriods)
+	}
+	if s.has(statCPUThrottled) {
+		e.Set(p+"cpu_throttled_periods", c.tags, s.cpuThrottled)
+	}
+	if s.has(statCPUThrottledTime) {
+		e.SetGauge(p+"cpu_throttled_seconds", c.tags, s.cpuThrottledTime)
+	}
+	if s.has(statMemoryLimit) {
+		e.SetGauge(p+"memory_limit_bytes", c.tags, s.memoryLimit)
+	}
+	if s.has(statMemoryUsage) {
+		e.SetGauge(p+"memory_usage_bytes", c.tags, s.memoryUsage)
+	}
+	if s.has(statMemoryUsage | statMemoryInactiveFile) {
+		e.SetGauge(p+"memory_working_set_bytes", c.tags, s.workingSet())
+	}
+	if s.has(statMemoryOOMKills) {
+		e.Set(p+"memory_oom_kills", c.tags, s.memoryOOMKills)
+	}
+	if s.has(statPidsLimit) {
+		e.SetGauge(p+"pids_limit", c.tags, s.pidsLimit)
+	}
+	if s.has(statPidsCurrent) {
+		e.SetGauge(p+"pids_current", c.tags, s.pidsCurrent)
+	}
+
+	return nil
+}
+
+func options(opts *Options) Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = defaultPrefix
+	}
+	if o.ProcPath == "" {
+		o.ProcPath = defaultProcPath
+	}
+	if o.CgroupPath == "" {
+		o.CgroupPath = defaultCgroupPath
+	}
+	return o
+}
+
+// discover returns the cgroup of the process from /proc/self/cgroup, a
+// unified (v2) hierarchy is used if mounted, otherwise the v1 controllers
+func discover(procPath, cgroupPath string) (*cgroup, error) {
+	data, err := ioutil.ReadFile(filepath.Join(procPath, "self", "cgroup"))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading cgroup")
+	}
+
+	// hierarchy-ID:controller-list:cgroup-path
+	v1 := make(map[string][2]string) // controller -> controller-list, path
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			if _, err := os.Stat(filepath.Join(cgroupPath, "cgroup.controllers")); err == nil {
+				dir := cgroupDir(cgroupPath, parts[2])
+				return &cgroup{version: 2, cpu: dir, cpuacct: dir, memory: dir, pids: dir}, nil
+			}
+			continue
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			v1[controller] = [2]string{parts[1], parts[2]}
+		}
+	}
+
+	if len(v1) == 0 {
+		return nil, errors.New("no cgroup found")
+	}
+
+	cg := &cgroup{version: 1}
+	for controller, dest := range map[string]*string{
+		"cpu":     &cg.cpu,
+		"cpuacct": &cg.cpuacct,
+		"memory":  &cg.memory,
+		"pids":    &cg.pids,
+	} {
+		if h, ok := v1[controller]; ok {
+			*dest = v1Dir(cgroupPath, controller, h[0], h[1])
+		}
+	}
+
+	return cg, nil
+}
+
+// cgroupDir returns the directory of the cgroup path in the hierarchy mounted
+// at root. In a container with its own cgroup namespace the cgroup is mounted
+// at root, the host path of the cgroup may not exist.
+func cgroupDir(root, path string) string {
+	dir := filepath.Join(root, path)
+	if _, err := os.Stat(dir); err == nil {
+		return dir
+	}
+	return root
+}
+
+// v1Dir returns the directory of a v1 controller, hierarchies are mounted
+// by the controller list (e.g. cpu,cpuacct) with links for each controller
+func v1Dir(root, controller, controllers, path string) string {
+	for _, name := range []string{controllers, controller} {
+		mount := filepath.Join(root, name)
+		if _, err := os.Stat(mount); err == nil {
+			return cgroupDir(mount, path)
+		}
+	}
+	return ""
+}
+
+// read returns the current statistics, missing controllers, files and keys
+// are skipped
+func (cg *cgroup) read() sample {
+	var s sample
+	if cg.version == 2 {
+		cg.readV2(&s)
+	} else {
+		cg.readV1(&s)
+	}
+	return s
+}
+
+func (cg *cgroup) readV2(s *sample) {
+	// cpu.max: $MAX $PERIOD, $MAX is "max" if there is no quota
+	if str, ok := readString(filepath.Join(cg.cpu, "cpu.max")); ok {
+		if fields := strings.Fields(str); len(fields) == 2 {
+			quota, qerr := strconv.ParseFloat(fields[0], 64)
+			period, perr := strconv.ParseFloat(fields[1], 64)
+			switch {
+			case fields[0] == "max":
+				s.read |= statCPUQuota
+			case qerr == nil && perr == nil && period > 0:
+				s.cpuQuota = quota / period
+				s.read |= statCPUQuota
+			}
+		}
+	}
+
+	cpuStat := readKeyValues(filepath.Join(cg.cpu, "cpu.stat"))
+	if v, ok := cpuStat["usage_usec"]; ok {
+		s.cpuUsage = float64(v) / 1e6
+		s.read |= statCPUUsage
+	}
+	if v, ok := cpuStat["nr_periods"]; ok {
+		s.cpuPeriods = v
+		s.read |= statCPUPeriods
+	}
+	if v, ok := cpuStat["nr_throttled"]; ok {
+		s.cpuThrottled = v
+		s.read |= statCPUThrottled
+	}
+	if v, ok := cpuStat["throttled_usec"]; ok {
+		s.cpuThrottledTime = float64(v) / 1e6
+		s.read |= statCPUThrottledTime
+	}
+
+	if v, ok := readLimit(filepath.Join(cg.memory, "memory.max")); ok {
+		s.memoryLimit = v
+		s.read |= statMemoryLimit
+	}
+	if v, ok := readUint(filepath.Join(cg.memory, "memory.current")); ok {
+		s.memoryUsage = v
+		s.read |= statMemoryUsage
+	}
+	if v, ok := readKeyValues(filepath.Join(cg.memory, "memory.stat"))["inactive_file"]; ok {
+		s.memoryInactiveFile = v
+		s.read |= statMemoryInactiveFile
+	}
+	if v, ok := readKeyValues(filepath.Join(cg.memory, "memory.events"))["oom_kill"]; ok {
+		s.memoryOOMKills = v
+		s.read |= statMemoryOOMKills
+	}
+
+	cg.readPids(s)
+}
+
+func (cg *cgroup) readV1(s *sample) {
+	if cg.cpu != "" {
+		// cpu.cfs_quota_us is -1 if there is no quota
+		if str, ok := readString(filepath.Join(cg.cpu, "cpu.cfs_quota_us")); ok {
+			if q, err := strconv.ParseFloat(str, 64); err == nil {
+				if q <= 0 {
+					s.read |= statCPUQuota
+				} else if period, ok := readUint(filepath.Join(cg.cpu, "cpu.cfs_period_us")); ok && period > 0 {
+					s.cpuQuota = q / float64(period)
+					s.read |= statCPUQuota
+				}
+			}
+		}
+
+		cpuStat := readKeyValues(filepath.Join(cg.cpu, "cpu.stat"))
+		if v, ok := cpuStat["nr_periods"]; ok {
+			s.cpuPeriods = v
+			s.read |= statCPUPeriods
+		}
+		if v, ok := cpuStat["nr_throttled"]; ok {
+			s.cpuThrottled = v
+			s.read |= statCPUThrottled
+		}
+		if v, ok := cpuStat["throttled_time"]; ok {
+			s.cpuThrottledTime = float64(v) / 1e9
+			s.read |= statCPUThrottledTime
+		}
+	}
+
+	if cg.cpuacct != "" {
+		if v, ok := readUint(filepath.Join(cg.cpuacct, "cpuacct.usage")); ok {
+			s.cpuUsage = float64(v) / 1e9
+			s.read |= statCPUUsage
+		}
+	}
+
+	if cg.memory != "" {
+		if limit, ok := readUint(filepath.Join(cg.memory, "memory.limit_in_bytes")); ok {
+			if limit < unlimitedV1 {
+				s.memoryLimit = limit
+			}
+			s.read |= statMemoryLimit
+		}
+		if v, ok := readUint(filepath.Join(cg.memory, "memory.usage_in_bytes")); ok {
+			s.memoryUsage = v
+			s.read |= statMemoryUsage
+		}
+		if v, ok := readKeyValues(filepath.Join(cg.memory, "memory.stat"))["total_inactive_file"]; ok {
+			s.memoryInactiveFile = v
+			s.read |= statMemoryInactiveFile
+		}
+		if v, ok := readKeyValues(filepath.Join(cg.memory, "memory.oom_control"))["oom_kill"]; ok {
+			s.memoryOOMKills = v
+			s.read |= statMemoryOOMKills
+		}
+	}
+
+	if cg.pids != "" {
+		cg.readPids(s)
+	}
+}
+
+// readPids reads the pids controller, the files are the same in v1 and v2
+func (cg *cgroup) readPids(s *sample) {
+	if v, ok := readLimit(filepath.Join(cg.pids, "pids.max")); ok {
+		s.pidsLimit = v
+		s.read |= statPidsLimit
+	}
+	if v, ok := readUint(filepath.Join(cg.pids, "pids.current")); ok {
+		s.pidsCurrent = v
+		s.read |= statPidsCurrent
+	}
+}
+
+// readString returns the trimmed content of a file and whether it could be read
+func readString(file string) (string, bool) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// readUint returns the value of a single value file and whether it could be
+// read and parsed
+func readUint(file string) (uint64, bool) {
+	str, ok := readString(file)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// readLimit returns the value of a limit file, 0 if the limit is "max"
+func readLimit(file string) (uint64, bool) {
+	str, ok := readString(file)
+	if !ok {
+		return 0, false
+	}
+	if str == "max" {
+		return 0, true
+	}
+	v, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// readKeyValues returns the values of a flat keyed file (e.g. cpu.stat),
+// nil if the file cannot be read
+func readKeyValues(file string) map[string]uint64 {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	kv := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			kv[fields[0]] = v
+		}
+	}
+
+	return kv
+}
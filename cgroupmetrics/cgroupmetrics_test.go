@@ -0,0 +1,224 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cgroupmetrics
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+func fixtureOptions(name string) *Options {
+	root := filepath.Join("testdata", name)
+	return &Options{
+		ProcPath:   filepath.Join(root, "proc"),
+		CgroupPath: filepath.Join(root, "sys", "fs", "cgroup"),
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		fixture string
+		version int
+		memory  string
+	}{
+		{"v2", 2, "v2/sys/fs/cgroup/system.slice/app.service"},
+		{"v2ns", 2, "v2ns/sys/fs/cgroup"},
+		{"v1", 1, "v1/sys/fs/cgroup/memory/docker/abc"},
+		{"v1unlimited", 1, "v1unlimited/sys/fs/cgroup/memory"},
+	}
+
+	for _, test := range tests {
+		o := fixtureOptions(test.fixture)
+		cg, err := discover(o.ProcPath, o.CgroupPath)
+		if err != nil {
+			t.Fatalf("%s unexpected error (%s)", test.fixture, err)
+		}
+		if cg.version != test.version {
+			t.Fatalf("%s expected v%d, got v%d", test.fixture, test.version, cg.version)
+		}
+		if expected := filepath.Join("testdata", test.memory); cg.memory != expected {
+			t.Fatalf("%s expected %s, got %s", test.fixture, expected, cg.memory)
+		}
+	}
+
+	if _, err := discover(filepath.Join("testdata", "missing"), defaultCgroupPath); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		expected sample
+	}{
+		{"v2", sample{
+			read: statCPUQuota | statCPUUsage | statCPUPeriods | statCPUThrottled | statCPUThrottledTime |
+				statMemoryLimit | statMemoryUsage | statMemoryInactiveFile | statMemoryOOMKills |
+				statPidsLimit | statPidsCurrent,
+			cpuQuota:           1.5,
+			cpuUsage:           5,
+			cpuPeriods:         120,
+			cpuThrottled:       7,
+			cpuThrottledTime:   0.35,
+			memoryLimit:        536870912,
+			memoryUsage:        104857600,
+			memoryInactiveFile: 10485760,
+			memoryOOMKills:     1,
+			pidsLimit:          0,
+			pidsCurrent:        42,
+		}},
+		{"v2ns", sample{
+			read:        statCPUQuota | statMemoryLimit | statMemoryUsage | statPidsLimit,
+			memoryUsage: 2048,
+			pidsLimit:   100,
+		}},
+		{"v1", sample{
+			read: statCPUQuota | statCPUUsage | statCPUPeriods | statCPUThrottled | statCPUThrottledTime |
+				statMemoryLimit | statMemoryUsage | statMemoryInactiveFile | statMemoryOOMKills |
+				statPidsLimit | statPidsCurrent,
+			cpuQuota:           0.5,
+			cpuUsage:           7.5,
+			cpuPeriods:         300,
+			cpuThrottled:       12,
+			cpuThrottledTime:   2.5,
+			memoryLimit:        268435456,
+			memoryUsage:        134217728,
+			memoryInactiveFile: 16777216,
+			memoryOOMKills:     3,
+			pidsLimit:          512,
+			pidsCurrent:        9,
+		}},
+		{"v1unlimited", sample{
+			read:        statMemoryLimit | statMemoryUsage,
+			memoryUsage: 1024,
+		}},
+	}
+
+	for _, test := range tests {
+		o := fixtureOptions(test.fixture)
+		cg, err := discover(o.ProcPath, o.CgroupPath)
+		if err != nil {
+			t.Fatalf("%s unexpected error (%s)", test.fixture, err)
+		}
+		if s := cg.read(); s != test.expected {
+			t.Fatalf("%s expected %+v, got %+v", test.fixture, test.expected, s)
+		}
+	}
+}
+
+func TestRegister(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	opts := fixtureOptions("v2")
+	opts.Tags = cgm.Tags{{Category: "app", Value: "test"}}
+
+	if err := Register(cm, opts); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output := *cm.FlushMetrics()
+
+	expected := map[string]interface{}{
+		"container_cpu_quota_cores":          float64(1.5),
+		"container_cpu_usage_seconds":        float64(5),
+		"container_cpu_periods":              uint64(120),
+		"container_cpu_throttled_periods":    uint64(7),
+		"container_cpu_throttled_seconds":    float64(0.35),
+		"container_memory_limit_bytes":       uint64(536870912),
+		"container_memory_usage_bytes":       uint64(104857600),
+		"container_memory_working_set_bytes": uint64(104857600 - 10485760),
+		"container_memory_oom_kills":         uint64(1),
+		"container_pids_limit":               uint64(0),
+		"container_pids_current":             uint64(42),
+	}
+
+	// plus the collector duration
+	if len(output) != len(expected)+1 {
+		t.Fatalf("expected %d metrics, got %d (%v)", len(expected)+1, len(output), output)
+	}
+
+	for name, value := range expected {
+		metric, ok := output[cm.MetricNameWithStreamTags(name, opts.Tags)]
+		if !ok {
+			t.Fatalf("expected %s", name)
+		}
+		if metric.Value != value {
+			t.Fatalf("%s expected %v (%T), got %v (%T)", name, value, value, metric.Value, metric.Value)
+		}
+	}
+
+	Unregister(cm, opts)
+
+	if output := *cm.FlushMetrics(); len(output) != 0 {
+		t.Fatalf("expected no metrics, got %v", output)
+	}
+}
+
+func TestCollectPartial(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	t.Log("only the statistics read are published")
+	{
+		if err := Register(cm, fixtureOptions("v2ns")); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+
+		output := *cm.FlushMetrics()
+
+		for _, name := range []string{"container_cpu_quota_cores", "container_memory_limit_bytes", "container_memory_usage_bytes", "container_pids_limit"} {
+			if _, ok := output[name]; !ok {
+				t.Fatalf("expected %s in %v", name, output)
+			}
+		}
+		for _, name := range []string{"container_cpu_usage_seconds", "container_memory_working_set_bytes", "container_memory_oom_kills", "container_pids_current"} {
+			if _, ok := output[name]; ok {
+				t.Fatalf("expected %s not to be published", name)
+			}
+		}
+
+		Unregister(cm, fixtureOptions("v2ns"))
+	}
+
+	t.Log("cgroup removed")
+	{
+		dir := filepath.Join("testdata", "missing")
+		cm.RegisterCollector("removed", &collector{
+			prefix: "removed_",
+			cg:     &cgroup{version: 2, cpu: dir, memory: dir, pids: dir},
+		}, 0)
+
+		output := *cm.FlushMetrics()
+
+		name := cm.MetricNameWithStreamTags("cgm_collector_errors", cgm.Tags{
+			{Category: "collector", Value: "removed"},
+			{Category: "error", Value: "error"},
+		})
+		if v, ok := output[name]; !ok || v.Value != uint64(1) {
+			t.Fatalf("expected %s to be 1, got %v", name, output)
+		}
+		for name := range output {
+			if strings.HasPrefix(name, "removed_") {
+				t.Fatalf("expected no metrics to be published, got %s", name)
+			}
+		}
+	}
+}
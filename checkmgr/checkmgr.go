@@ -168,6 +168,7 @@ type CheckManager struct {
 	brokerTLS             *tls.Config            // broker
 	certPool              *x509.CertPool         // state
 	sockRx                *regexp.Regexp         // state
+	trap                  *Trap                  // state
 	Log                   Logger                 // general
 	trapLastUpdate        time.Time              // state
 	checkType             CheckTypeType          // check
@@ -190,6 +191,7 @@ type CheckManager struct {
 	initializedmu         sync.RWMutex           // general
 	cbmu                  sync.Mutex             // state
 	trapmu                sync.Mutex             // state
+	trapcmu               sync.Mutex             // state
 	mtmu                  sync.Mutex             // metric tags
 	availableMetricsmu    sync.Mutex             // state
 	enabled               bool                   // general
@@ -197,6 +199,7 @@ type CheckManager struct {
 	Debug                 bool                   // general
 	serialInit            bool                   // general
 	initialized           bool                   // general
+	shutdown              bool                   // general
 	forceMetricActivation bool                   // check
 	forceCheckUpdate      bool                   // check
 }
@@ -206,6 +209,7 @@ type Trap struct {
 	URL           *url.URL
 	TLS           *tls.Config
 	SockTransport *httpunix.Transport
+	src           apiclient.URLType
 	IsSocket      bool
 }
 
@@ -395,21 +399,46 @@ func (cm *CheckManager) Initialize() error {
 
 	// background initialization when we have to reach out to the api
 	go func() {
+		cm.initializedmu.Lock()
+		if cm.shutdown {
+			cm.initializedmu.Unlock()
+			return
+		}
 		cm.apih.EnableExponentialBackoff()
+		cm.initializedmu.Unlock()
+
 		err := cm.initializeTrapURL()
-		if err == nil {
-			cm.initializedmu.Lock()
+
+		cm.initializedmu.Lock()
+		if err == nil && !cm.shutdown {
 			cm.initialized = true
-			cm.initializedmu.Unlock()
-		} else {
+		} else if err != nil {
 			cm.Log.Printf("error initializing trap %s", err.Error())
 		}
+		cm.initializedmu.Unlock()
 		cm.apih.DisableExponentialBackoff()
 	}()
 
 	return nil // we can't return an error from a go function after the fact
 }
 
+// Shutdown releases a background initialization which may still be running.
+// Exponential backoff is disabled on the api client so the next failed api
+// call returns instead of retrying indefinitely.
+func (cm *CheckManager) Shutdown() {
+	cm.initializedmu.Lock()
+	defer cm.initializedmu.Unlock()
+
+	if cm.shutdown {
+		return
+	}
+	cm.shutdown = true
+
+	if cm.apih != nil {
+		cm.apih.DisableExponentialBackoff()
+	}
+}
+
 // IsReady reflects if the check has been initialied and metrics can be sent to Circonus
 func (cm *CheckManager) IsReady() bool {
 	cm.initializedmu.RLock()
@@ -417,13 +446,33 @@ func (cm *CheckManager) IsReady() bool {
 	return cm.initialized
 }
 
-// GetSubmissionURL returns submission url for circonus
+// GetSubmissionURL returns submission url for circonus. The same Trap is
+// returned until the trap is reset (e.g. via RefreshTrap or ResetTrap), so
+// callers can reuse anything derived from it (e.g. http clients).
 func (cm *CheckManager) GetSubmissionURL() (*Trap, error) {
 	if cm.trapURL == "" {
 		return nil, errors.Errorf("get submission url - submission url unavailable")
 	}
 
-	trap := &Trap{}
+	cm.trapcmu.Lock()
+	defer cm.trapcmu.Unlock()
+
+	if cm.trap != nil && cm.trap.src == cm.trapURL {
+		return cm.trap, nil
+	}
+
+	trap, err := cm.newTrap()
+	if err != nil {
+		return nil, err
+	}
+	cm.trap = trap
+
+	return trap, nil
+}
+
+// newTrap builds the Trap for the current submission url
+func (cm *CheckManager) newTrap() (*Trap, error) {
+	trap := &Trap{src: cm.trapURL}
 
 	u, err := url.Parse(string(cm.trapURL))
 	if err != nil {
@@ -533,6 +582,9 @@ func (cm *CheckManager) ResetTrap() error {
 
 	cm.trapURL = ""
 	cm.certPool = nil // force re-fetching CA cert (if custom TLS config not supplied)
+	cm.trapcmu.Lock()
+	cm.trap = nil
+	cm.trapcmu.Unlock()
 	return cm.initializeTrapURL()
 }
 
@@ -30,10 +30,13 @@
 package circonusgometrics
 
 import (
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"regexp"
 	"strconv"
@@ -43,11 +46,17 @@ import (
 
 	"github.com/circonus-labs/circonus-gometrics/v3/checkmgr"
 	"github.com/circonus-labs/go-apiclient"
+	"github.com/openhistogram/circonusllhist"
 	"github.com/pkg/errors"
 )
 
 const (
-	defaultFlushInterval = "10s" // 10 * time.Second
+	defaultFlushInterval       = "10s" // 10 * time.Second
+	defaultTrapMaxIdleConns    = "2"
+	defaultTrapIdleConnTimeout = "90s"
+
+	compressionGzip    = "gzip"
+	compressionDeflate = "deflate"
 
 	// MetricTypeInt32 reconnoiter
 	MetricTypeInt32 = "i"
@@ -117,6 +126,43 @@ type Config struct {
 	// API, Check and Broker configuration options
 	CheckManager checkmgr.Config
 
+	// directory in which to spool payloads which could not be submitted,
+	// spooled payloads are replayed on subsequent flushes. Default is
+	// no spooling.
+	SpoolDir string
+	// maximum total size, in bytes, of spooled payloads (default 10485760)
+	SpoolMaxSize string
+	// maximum age of a spooled payload, e.g. 30m, 1h, etc. (default 1h)
+	SpoolMaxAge string
+
+	// compress payloads sent to the broker, "gzip" or "deflate" (default none).
+	// If the broker rejects a compressed payload, cgm falls back to uncompressed.
+	TrapCompression string
+	// compression level, -1 (default) through 9
+	TrapCompressionLevel string
+
+	// maximum number of metrics sent in a single request, metrics are split
+	// into multiple requests when exceeded (default 0, unlimited)
+	MaxMetricsPerRequest string
+	// maximum size, in bytes, of a single request (default 0, unlimited)
+	MaxBytesPerRequest string
+	// number of requests sent concurrently when metrics are split (default 1)
+	SubmitConcurrency string
+
+	// deliver metrics with a custom Submitter rather than sending them
+	// to the check submission url (default: httptrap/circonus-agent).
+	// When set, no check manager is created and CheckManager is ignored.
+	Submitter Submitter
+
+	// maximum number of idle (keep-alive) connections to the broker (default 2).
+	// Set to "0" to close the connection after each submission.
+	TrapMaxIdleConns string
+	// how long an idle connection to the broker is kept open (default 90s)
+	TrapIdleConnTimeout string
+
+	// maximum time a registered Collector may run on each flush (default 5s)
+	CollectorTimeout string
+
 	Debug       bool
 	DumpMetrics bool
 }
@@ -125,40 +171,71 @@ type prevMetrics struct {
 	ts        time.Time
 	metricsmu sync.Mutex
 	metrics   *Metrics
+	counters  map[string]bool // names of the counters in metrics
+	// reset settings used to package metrics, FlushMetricsNoReset overrides them
+	resetCounters   bool
+	resetHistograms bool
 }
 
 // CirconusMetrics state
 type CirconusMetrics struct {
-	Log             Logger
-	lastMetrics     *prevMetrics
-	check           *checkmgr.CheckManager
-	gauges          map[string]interface{}
-	histograms      map[string]*Histogram
-	custom          map[string]Metric
-	text            map[string]string
-	textFuncs       map[string]func() string
-	counterFuncs    map[string]func() uint64
-	gaugeFuncs      map[string]func() int64
-	counters        map[string]uint64
-	submitTimestamp *time.Time
-	flushInterval   time.Duration
-	flushmu         sync.Mutex
-	packagingmu     sync.Mutex
-	cm              sync.Mutex
-	cfm             sync.Mutex
-	gm              sync.Mutex
-	gfm             sync.Mutex
-	hm              sync.Mutex
-	tm              sync.Mutex
-	tfm             sync.Mutex
-	custm           sync.Mutex
-	flushing        bool
-	Debug           bool
-	DumpMetrics     bool
-	resetCounters   bool
-	resetGauges     bool
-	resetHistograms bool
-	resetText       bool
+	Log                  Logger
+	lastMetrics          *prevMetrics
+	counters             counterShards
+	check                *checkmgr.CheckManager
+	spool                *spool
+	submitter            Submitter
+	trap                 *checkmgr.Trap
+	trapClient           *http.Client
+	gauges               map[string]interface{}
+	histograms           map[string]*Histogram
+	cumulativeHistograms map[string]*Histogram
+	custom               map[string]Metric
+	text                 map[string]string
+	textFuncs            map[string]func() string
+	counterFuncs         map[string]func() uint64
+	gaugeFuncs           map[string]func() int64
+	gaugeFloat64Funcs    map[string]func() float64
+	gaugeUint64Funcs     map[string]func() uint64
+	gaugeHandles         map[string]*Gauge
+	histogramFuncs       map[string]func() *circonusllhist.Histogram
+	collectors           map[string]*registeredCollector
+	textHandles          map[string]*Text
+	submitTimestamp      *time.Time
+	flushTicker          *time.Ticker
+	shutdown             chan struct{}
+	flushDone            chan struct{} // closed when the flush in progress completes
+	flushInterval        time.Duration
+	trapIdleConnTimeout  time.Duration
+	collectorTimeout     time.Duration
+	trapMaxIdleConns     int
+	maxMetricsPerRequest int
+	maxBytesPerRequest   int
+	submitConcurrency    int
+	trapCompressionLevel int
+	trapCompression      string
+	autoflushwg          sync.WaitGroup
+	stopOnce             sync.Once
+	flushmu              sync.Mutex
+	packagingmu          sync.Mutex
+	cfm                  sync.Mutex
+	gm                   sync.Mutex
+	gfm                  sync.Mutex
+	hm                   sync.RWMutex
+	hfm                  sync.Mutex
+	colm                 sync.Mutex
+	tm                   sync.Mutex
+	tfm                  sync.Mutex
+	custm                sync.Mutex
+	trapcm               sync.Mutex
+	flushing             bool
+	Debug                bool
+	DumpMetrics          bool
+	resetCounters        bool
+	resetGauges          bool
+	resetHistograms      bool
+	resetText            bool
+	trapCompressionOff   bool
 }
 
 // NewCirconusMetrics returns a CirconusMetrics instance
@@ -174,15 +251,22 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 	}
 
 	cm := &CirconusMetrics{
-		counters:     make(map[string]uint64),
-		counterFuncs: make(map[string]func() uint64),
-		gauges:       make(map[string]interface{}),
-		gaugeFuncs:   make(map[string]func() int64),
-		histograms:   make(map[string]*Histogram),
-		text:         make(map[string]string),
-		textFuncs:    make(map[string]func() string),
-		custom:       make(map[string]Metric),
-		lastMetrics:  &prevMetrics{},
+		gaugeHandles:         make(map[string]*Gauge),
+		textHandles:          make(map[string]*Text),
+		counterFuncs:         make(map[string]func() uint64),
+		gauges:               make(map[string]interface{}),
+		gaugeFuncs:           make(map[string]func() int64),
+		gaugeFloat64Funcs:    make(map[string]func() float64),
+		gaugeUint64Funcs:     make(map[string]func() uint64),
+		histograms:           make(map[string]*Histogram),
+		histogramFuncs:       make(map[string]func() *circonusllhist.Histogram),
+		cumulativeHistograms: make(map[string]*Histogram),
+		collectors:           make(map[string]*registeredCollector),
+		text:                 make(map[string]string),
+		textFuncs:            make(map[string]func() string),
+		custom:               make(map[string]Metric),
+		lastMetrics:          &prevMetrics{},
+		shutdown:             make(chan struct{}),
 	}
 
 	// Logging
@@ -251,8 +335,137 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 		cm.resetText = setting
 	}
 
-	// check manager
+	// metric submission
+	cm.submitter = cfg.Submitter
+	if cm.submitter == nil {
+		cm.submitter = &trapSubmitter{m: cm}
+	}
+
+	// trap connection pool
+	{
+		mic := defaultTrapMaxIdleConns
+		if cfg.TrapMaxIdleConns != "" {
+			mic = cfg.TrapMaxIdleConns
+		}
+		maxIdle, err := strconv.Atoi(mic)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing trap max idle conns")
+		}
+		if maxIdle < 0 {
+			return nil, errors.Errorf("invalid trap max idle conns (%d)", maxIdle)
+		}
+		cm.trapMaxIdleConns = maxIdle
+
+		ict := defaultTrapIdleConnTimeout
+		if cfg.TrapIdleConnTimeout != "" {
+			ict = cfg.TrapIdleConnTimeout
+		}
+		dur, err := time.ParseDuration(ict)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing trap idle conn timeout")
+		}
+		cm.trapIdleConnTimeout = dur
+	}
+
+	// collectors
 	{
+		ct := defaultCollectorTimeout
+		if cfg.CollectorTimeout != "" {
+			ct = cfg.CollectorTimeout
+		}
+		dur, err := time.ParseDuration(ct)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing collector timeout")
+		}
+		if dur <= 0 {
+			return nil, errors.Errorf("invalid collector timeout (%s)", dur)
+		}
+		cm.collectorTimeout = dur
+	}
+
+	// request splitting
+	if cfg.MaxMetricsPerRequest != "" {
+		n, err := strconv.Atoi(cfg.MaxMetricsPerRequest)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing max metrics per request")
+		}
+		if n < 0 {
+			return nil, errors.Errorf("invalid max metrics per request (%d)", n)
+		}
+		cm.maxMetricsPerRequest = n
+	}
+
+	if cfg.MaxBytesPerRequest != "" {
+		n, err := strconv.Atoi(cfg.MaxBytesPerRequest)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing max bytes per request")
+		}
+		if n < 0 {
+			return nil, errors.Errorf("invalid max bytes per request (%d)", n)
+		}
+		cm.maxBytesPerRequest = n
+	}
+
+	cm.submitConcurrency = 1
+	if cfg.SubmitConcurrency != "" {
+		n, err := strconv.Atoi(cfg.SubmitConcurrency)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing submit concurrency")
+		}
+		if n < 1 {
+			return nil, errors.Errorf("invalid submit concurrency (%d)", n)
+		}
+		cm.submitConcurrency = n
+	}
+
+	// trap payload compression
+	switch cfg.TrapCompression {
+	case "", compressionGzip, compressionDeflate:
+		cm.trapCompression = cfg.TrapCompression
+	default:
+		return nil, errors.Errorf("invalid trap compression (%s)", cfg.TrapCompression)
+	}
+	cm.trapCompressionLevel = gzip.DefaultCompression
+	if cfg.TrapCompressionLevel != "" {
+		level, err := strconv.Atoi(cfg.TrapCompressionLevel)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing trap compression level")
+		}
+		if level < gzip.DefaultCompression || level > gzip.BestCompression {
+			return nil, errors.Errorf("invalid trap compression level (%d)", level)
+		}
+		cm.trapCompressionLevel = level
+	}
+
+	// spool for failed submissions
+	if cfg.SpoolDir != "" {
+		ms := defaultSpoolMaxSize
+		if cfg.SpoolMaxSize != "" {
+			ms = cfg.SpoolMaxSize
+		}
+		maxSize, err := strconv.ParseInt(ms, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing spool max size")
+		}
+
+		ma := defaultSpoolMaxAge
+		if cfg.SpoolMaxAge != "" {
+			ma = cfg.SpoolMaxAge
+		}
+		maxAge, err := time.ParseDuration(ma)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing spool max age")
+		}
+
+		s, err := newSpool(cfg.SpoolDir, maxSize, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		cm.spool = s
+	}
+
+	// check manager, not needed when metrics are delivered by a custom Submitter
+	if cfg.Submitter == nil {
 		cfg.CheckManager.Debug = cm.Debug
 		cfg.CheckManager.Log = cm.Log
 
@@ -261,19 +474,27 @@ func New(cfg *Config) (*CirconusMetrics, error) {
 			return nil, errors.Wrap(err, "creating new check manager")
 		}
 		cm.check = check
-	}
 
-	// start initialization (serialized or background)
-	if err := cm.check.Initialize(); err != nil {
-		return nil, err
+		// start initialization (serialized or background)
+		if err := cm.check.Initialize(); err != nil {
+			return nil, err
+		}
 	}
 
 	// if automatic flush is enabled, start it.
 	// NOTE: submit will jettison metrics until initialization has completed.
 	if cm.flushInterval > time.Duration(0) {
+		cm.flushTicker = time.NewTicker(cm.flushInterval)
+		cm.autoflushwg.Add(1)
 		go func() {
-			for range time.NewTicker(cm.flushInterval).C {
-				cm.Flush()
+			defer cm.autoflushwg.Done()
+			for {
+				select {
+				case <-cm.shutdown:
+					return
+				case <-cm.flushTicker.C:
+					cm.Flush()
+				}
 			}
 		}()
 	}
@@ -286,8 +507,82 @@ func (m *CirconusMetrics) Start() {
 	// nop
 }
 
-// Ready returns true or false indicating if the check is ready to accept metrics
+// Stop halts the automatic flush (if enabled) and waits for an automatic flush
+// already in progress to complete. Metrics are not submitted, use Close to
+// submit any outstanding metrics before exiting.
+func (m *CirconusMetrics) Stop() {
+	m.stopOnce.Do(func() {
+		if m.flushTicker != nil {
+			m.flushTicker.Stop()
+		}
+		close(m.shutdown)
+	})
+	m.autoflushwg.Wait()
+}
+
+// Close stops the automatic flush, waits for any in-flight flush to complete,
+// performs a final submission of outstanding metrics and releases the check
+// manager. The context bounds how long Close will wait.
+func (m *CirconusMetrics) Close(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "stopping automatic flush")
+	case <-stopped:
+	}
+
+	// wait for a manual flush which may be in progress, then claim
+	// the flush so nothing else runs concurrently with the final submission
+	for {
+		m.flushmu.Lock()
+		if !m.flushing {
+			m.flushing = true
+			m.flushDone = make(chan struct{})
+			m.flushmu.Unlock()
+			break
+		}
+		done := m.flushDone
+		m.flushmu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for flush")
+		case <-done:
+		}
+	}
+
+	if m.check != nil {
+		defer m.check.Shutdown()
+	}
+
+	_, err := m.flush(ctx)
+
+	m.endFlush()
+
+	m.trapcm.Lock()
+	if m.trapClient != nil {
+		m.trapClient.CloseIdleConnections()
+	}
+	m.trapcm.Unlock()
+
+	if err != nil {
+		return errors.Wrap(err, "final flush")
+	}
+
+	return nil
+}
+
+// Ready returns true or false indicating if the check is ready to accept metrics,
+// always true when metrics are delivered by a custom Submitter
 func (m *CirconusMetrics) Ready() bool {
+	if m.check == nil {
+		return true
+	}
 	return m.check.IsReady()
 }
 
@@ -306,10 +601,16 @@ func (m *CirconusMetrics) Custom(metricName string, metric Metric) error {
 
 // GetBrokerTLSConfig returns the tls.Config for the broker
 func (m *CirconusMetrics) GetBrokerTLSConfig() *tls.Config {
+	if m.check == nil {
+		return nil
+	}
 	return m.check.BrokerTLSConfig()
 }
 
 func (m *CirconusMetrics) GetCheckBundle() *apiclient.CheckBundle {
+	if m.check == nil {
+		return nil
+	}
 	return m.check.GetCheckBundle()
 }
 
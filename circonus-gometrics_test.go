@@ -5,12 +5,14 @@
 package circonusgometrics
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -291,4 +293,122 @@ func TestNew(t *testing.T) {
 			t.Fatalf("Expected %v got '%v'", expectedError, err)
 		}
 	}
+
+	t.Log("trap max idle conns [good(0)]")
+	{
+		cfg := &Config{
+			TrapMaxIdleConns: "0",
+		}
+		cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+		_, err := New(cfg)
+		if err != nil {
+			t.Errorf("Expected no error, got '%v'", err)
+		}
+	}
+	t.Log("trap max idle conns [bad(-1)]")
+	{
+		cfg := &Config{
+			TrapMaxIdleConns: "-1",
+		}
+		cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+		expectedError := errors.New("invalid trap max idle conns (-1)")
+		_, err := New(cfg)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if err.Error() != expectedError.Error() {
+			t.Fatalf("Expected %v got '%v'", expectedError, err)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	var submissions uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&submissions, 1)
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"stats":1}`)
+	}))
+	defer server.Close()
+
+	t.Log("final flush")
+	{
+		cfg := &Config{Interval: "1h"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.Increment("foo")
+
+		if err := cm.Close(context.Background()); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		if n := atomic.LoadUint64(&submissions); n != 1 {
+			t.Fatalf("Expected 1 submission, got %d", n)
+		}
+
+		if _, err := cm.GetCounterTest("foo"); err == nil {
+			t.Fatal("Expected error, counter should have been flushed")
+		}
+
+		// stop after close is a nop
+		cm.Stop()
+	}
+
+	t.Log("in-flight flush, context canceled")
+	{
+		cfg := &Config{Interval: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.startFlush()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := cm.Close(ctx); err == nil {
+			t.Fatal("Expected error")
+		} else if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Expected deadline exceeded, got '%v'", err)
+		}
+	}
+
+	t.Log("in-flight flush completes")
+	{
+		cfg := &Config{Interval: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+
+		cm, err := New(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.startFlush()
+		cm.Increment("foo")
+		before := atomic.LoadUint64(&submissions)
+
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cm.endFlush()
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := cm.Close(ctx); err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if n := atomic.LoadUint64(&submissions); n != before+1 {
+			t.Fatalf("Expected final submission, got %d", n-before)
+		}
+	}
 }
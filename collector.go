@@ -0,0 +1,243 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultCollectorTimeout = "5s"
+
+	// collector self-metrics
+	collectorDurationMetric = "cgm_collector_duration"
+	collectorErrorsMetric   = "cgm_collector_errors"
+	collectorTagCategory    = "collector"
+	collectorErrorCategory  = "error"
+	collectorErrorError     = "error"
+	collectorErrorTimeout   = "timeout"
+	collectorErrorPanic     = "panic"
+	collectorErrorBusy      = "busy"
+)
+
+// A Collector gathers metrics on demand. Registered collectors are run on
+// every flush, before metrics are snapshotted, and emit their metrics through
+// the Emitter. Collect should return promptly once ctx is done.
+type Collector interface {
+	Collect(ctx context.Context, e *Emitter) error
+}
+
+// CollectorFunc is an adapter allowing an ordinary function to be used as a Collector.
+type CollectorFunc func(ctx context.Context, e *Emitter) error
+
+// Collect calls f(ctx, e).
+func (f CollectorFunc) Collect(ctx context.Context, e *Emitter) error {
+	return f(ctx, e)
+}
+
+// An Emitter records metrics on behalf of a collector. Metrics emitted after
+// the collector has timed out are dropped.
+type Emitter struct {
+	m      *CirconusMetrics
+	closed uint32 // atomic
+}
+
+func (e *Emitter) open() bool {
+	return atomic.LoadUint32(&e.closed) == 0
+}
+
+func (e *Emitter) close() {
+	atomic.StoreUint32(&e.closed, 1)
+}
+
+// Set sets a counter metric with tags to a fixed value
+func (e *Emitter) Set(metric string, tags Tags, val uint64) {
+	if e.open() {
+		e.m.SetWithTags(metric, tags, val)
+	}
+}
+
+// Add increments a counter metric with tags by a specific value
+func (e *Emitter) Add(metric string, tags Tags, val uint64) {
+	if e.open() {
+		e.m.AddWithTags(metric, tags, val)
+	}
+}
+
+// SetGauge sets a gauge metric with tags to a value
+func (e *Emitter) SetGauge(metric string, tags Tags, val interface{}) {
+	if e.open() {
+		e.m.SetGaugeWithTags(metric, tags, val)
+	}
+}
+
+// SetText sets a text metric with tags
+func (e *Emitter) SetText(metric string, tags Tags, val string) {
+	if e.open() {
+		e.m.SetTextWithTags(metric, tags, val)
+	}
+}
+
+// RecordValue adds a value to a histogram metric with tags
+func (e *Emitter) RecordValue(metric string, tags Tags, val float64) {
+	if e.open() {
+		e.m.RecordValueWithTags(metric, tags, val)
+	}
+}
+
+// RecordDuration adds a time.Duration to a histogram metric with tags
+func (e *Emitter) RecordDuration(metric string, tags Tags, val time.Duration) {
+	if e.open() {
+		e.m.RecordDurationWithTags(metric, tags, val)
+	}
+}
+
+// MergeHistogram merges all of the values in hist into a histogram metric with tags
+func (e *Emitter) MergeHistogram(metric string, tags Tags, hist *circonusllhist.Histogram) {
+	if hist == nil || !e.open() {
+		return
+	}
+	err := e.m.recordHistogram(e.m.MetricNameWithStreamTags(metric, tags), false, func(h *circonusllhist.Histogram) error {
+		h.Merge(hist)
+		return nil
+	})
+	if err != nil {
+		e.m.Log.Printf("error merging histogram (%v)\n", err)
+	}
+}
+
+type registeredCollector struct {
+	c       Collector
+	name    string
+	timeout time.Duration
+	running uint32 // atomic, a timed out collector may still be running
+}
+
+// RegisterCollector registers a collector to be run on every flush. Each run
+// is limited to timeout, if timeout is zero the configured CollectorTimeout is
+// used. Registering a collector with the name of an existing one replaces it.
+func (m *CirconusMetrics) RegisterCollector(name string, c Collector, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = m.collectorTimeout
+	}
+	m.colm.Lock()
+	defer m.colm.Unlock()
+	if m.collectors == nil {
+		m.collectors = make(map[string]*registeredCollector)
+	}
+	m.collectors[name] = &registeredCollector{name: name, c: c, timeout: timeout}
+}
+
+// UnregisterCollector removes a collector
+func (m *CirconusMetrics) UnregisterCollector(name string) {
+	m.colm.Lock()
+	defer m.colm.Unlock()
+	delete(m.collectors, name)
+}
+
+// runCollectors runs all registered collectors concurrently and waits for
+// each of them to finish or time out.
+func (m *CirconusMetrics) runCollectors() {
+	m.colm.Lock()
+	if len(m.collectors) == 0 {
+		m.colm.Unlock()
+		return
+	}
+	collectors := make([]*registeredCollector, 0, len(m.collectors))
+	for _, rc := range m.collectors {
+		collectors = append(collectors, rc)
+	}
+	m.colm.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name < collectors[j].name })
+
+	var wg sync.WaitGroup
+	for _, rc := range collectors {
+		wg.Add(1)
+		go func(rc *registeredCollector) {
+			defer wg.Done()
+			m.runCollector(rc)
+		}(rc)
+	}
+	wg.Wait()
+}
+
+// runCollector runs a single collector, recording its runtime and any errors.
+func (m *CirconusMetrics) runCollector(rc *registeredCollector) {
+	tags := Tags{{Category: collectorTagCategory, Value: rc.name}}
+
+	if !atomic.CompareAndSwapUint32(&rc.running, 0, 1) {
+		m.collectorError(rc.name, collectorErrorBusy, errors.New("previous run has not finished"))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), rc.timeout)
+	defer cancel()
+
+	e := &Emitter{m: m}
+	done := make(chan error, 1)
+	start := time.Now()
+
+	go func() {
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = &collectorPanic{value: r}
+			}
+			atomic.StoreUint32(&rc.running, 0)
+			done <- err
+		}()
+		err = rc.c.Collect(ctx, e)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	e.close()
+
+	m.RecordDurationWithTags(collectorDurationMetric, tags, time.Since(start))
+
+	if err == nil {
+		return
+	}
+
+	var p *collectorPanic
+	switch {
+	case errors.As(err, &p):
+		m.collectorError(rc.name, collectorErrorPanic, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		m.collectorError(rc.name, collectorErrorTimeout, errors.Errorf("timed out after %s", rc.timeout))
+	default:
+		m.collectorError(rc.name, collectorErrorError, err)
+	}
+}
+
+func (m *CirconusMetrics) collectorError(name, class string, err error) {
+	m.Log.Printf("[WARN] collector %s: %v\n", name, err)
+	m.IncrementWithTags(collectorErrorsMetric, Tags{
+		{Category: collectorTagCategory, Value: name},
+		{Category: collectorErrorCategory, Value: class},
+	})
+}
+
+// collectorPanic is a panic recovered from a collector
+type collectorPanic struct {
+	value interface{}
+}
+
+func (p *collectorPanic) Error() string {
+	return fmt.Sprintf("panic: %v", p.value)
+}
@@ -0,0 +1,178 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func TestCollector(t *testing.T) {
+	t.Log("Testing collector.RegisterCollector")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	tags := Tags{{"foo", "bar"}}
+	calls := 0
+	cm.RegisterCollector("test", CollectorFunc(func(ctx context.Context, e *Emitter) error {
+		calls++
+		hist := circonusllhist.New()
+		_ = hist.RecordValue(1)
+		_ = hist.RecordValue(2)
+
+		e.Set("counter", tags, 10)
+		e.Add("counter", tags, 5)
+		e.SetGauge("gauge", tags, 1.5)
+		e.SetText("text", tags, "hello")
+		e.RecordValue("hist", tags, 3)
+		e.MergeHistogram("hist", tags, hist)
+		e.MergeHistogram("hist", tags, nil)
+		return nil
+	}), 0)
+
+	m := *cm.FlushMetrics()
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+
+	counterName := cm.MetricNameWithStreamTags("counter", tags)
+	if v, ok := m[counterName]; !ok || v.Value.(uint64) != 15 {
+		t.Fatalf("expected counter 15, got %v", m[counterName])
+	}
+	gaugeName := cm.MetricNameWithStreamTags("gauge", tags)
+	if v, ok := m[gaugeName]; !ok || v.Value.(float64) != 1.5 {
+		t.Fatalf("expected gauge 1.5, got %v", m[gaugeName])
+	}
+	textName := cm.MetricNameWithStreamTags("text", tags)
+	if v, ok := m[textName]; !ok || v.Value.(string) != "hello" {
+		t.Fatalf("expected text 'hello', got %v", m[textName])
+	}
+	histName := cm.MetricNameWithStreamTags("hist", tags)
+	if _, ok := m[histName]; !ok {
+		t.Fatalf("expected histogram %s", histName)
+	}
+
+	durName := cm.MetricNameWithStreamTags(collectorDurationMetric, Tags{{collectorTagCategory, "test"}})
+	if _, ok := m[durName]; !ok {
+		t.Fatalf("expected collector duration %s", durName)
+	}
+
+	// collectors run on every flush
+	cm.FlushMetrics()
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+
+	cm.UnregisterCollector("test")
+	cm.FlushMetrics()
+	if calls != 2 {
+		t.Fatalf("expected 2 calls after unregister, got %d", calls)
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	t.Log("Testing collector errors, panics and timeouts")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	cm.RegisterCollector("error", CollectorFunc(func(ctx context.Context, e *Emitter) error {
+		return errors.New("failed")
+	}), 0)
+	cm.RegisterCollector("panic", CollectorFunc(func(ctx context.Context, e *Emitter) error {
+		panic("boom")
+	}), 0)
+	cm.RegisterCollector("timeout", CollectorFunc(func(ctx context.Context, e *Emitter) error {
+		defer close(done)
+		<-release // ignores ctx
+		e.SetGauge("late", nil, 1)
+		return nil
+	}), 10*time.Millisecond)
+
+	m := *cm.FlushMetrics()
+
+	// collectors are named after the error class they produce
+	for _, class := range []string{collectorErrorError, collectorErrorPanic, collectorErrorTimeout} {
+		name := cm.MetricNameWithStreamTags(collectorErrorsMetric, Tags{
+			{collectorTagCategory, class},
+			{collectorErrorCategory, class},
+		})
+		if v, ok := m[name]; !ok || v.Value.(uint64) != 1 {
+			t.Fatalf("expected %s to be 1, got %v", name, m[name])
+		}
+	}
+
+	// still running from the previous flush
+	m = *cm.FlushMetrics()
+	busyName := cm.MetricNameWithStreamTags(collectorErrorsMetric, Tags{
+		{collectorTagCategory, "timeout"},
+		{collectorErrorCategory, collectorErrorBusy},
+	})
+	if v, ok := m[busyName]; !ok || v.Value.(uint64) != 1 {
+		t.Fatalf("expected %s to be 1, got %v", busyName, m[busyName])
+	}
+
+	// metrics emitted after a timeout are dropped
+	cm.UnregisterCollector("timeout")
+	close(release)
+	<-done
+	m = *cm.FlushMetrics()
+	if _, ok := m["late"]; ok {
+		t.Fatal("expected metric emitted after timeout to be dropped")
+	}
+}
+
+func TestCollectorTimeoutConfig(t *testing.T) {
+	t.Log("Testing collector timeout config")
+
+	for _, ct := range []string{"abc", "0s"} {
+		cfg := &Config{}
+		cfg.CheckManager.Check.SubmissionURL = "none"
+		cfg.Interval = "0"
+		cfg.CollectorTimeout = ct
+
+		if _, err := NewCirconusMetrics(cfg); err == nil {
+			t.Fatalf("expected error for collector timeout %q", ct)
+		}
+	}
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cfg.CollectorTimeout = "1s"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	if cm.collectorTimeout != time.Second {
+		t.Fatalf("expected 1s, got %s", cm.collectorTimeout)
+	}
+
+	cm.RegisterCollector("test", CollectorFunc(func(ctx context.Context, e *Emitter) error { return nil }), 0)
+	if rc := cm.collectors["test"]; rc.timeout != time.Second {
+		t.Fatalf("expected default timeout 1s, got %s", rc.timeout)
+	}
+}
@@ -4,12 +4,203 @@
 
 package circonusgometrics
 
-import "github.com/pkg/errors"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
 
 // A Counter is a monotonically increasing unsigned integer.
 //
 // Use a counter to derive rates (e.g., record total number of requests, derive
 // requests per second).
+type Counter struct {
+	value   uint64 // atomic
+	touched uint32 // atomic, counter updated since last flush
+	name    string
+	pinned  bool // instance returned by NewCounter, retained across resets
+}
+
+// counterShardCount is the number of shards counters are spread across
+const counterShardCount = 32
+
+// counterShard holds the counters whose names hash to the shard. Updates to
+// existing counters only take the read lock, the value is updated atomically.
+type counterShard struct {
+	counters map[string]*Counter
+	mu       sync.RWMutex
+}
+
+// counterShards spreads counters across shards by name hash so updates to
+// different counters rarely contend
+type counterShards [counterShardCount]counterShard
+
+// shard returns the shard for the named counter (fnv-1a hash of name)
+func (cs *counterShards) shard(name string) *counterShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &cs[h%counterShardCount]
+}
+
+// update applies fn to the named counter, creating the counter if needed.
+// The shard read lock is held while updating so a flush cannot stop
+// tracking the counter mid-update.
+func (cs *counterShards) update(name string, fn func(*Counter)) {
+	s := cs.shard(name)
+
+	s.mu.RLock()
+	if c, ok := s.counters[name]; ok {
+		fn(c)
+		s.mu.RUnlock()
+		return
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	fn(s.counter(name))
+	s.mu.Unlock()
+}
+
+// get returns the value of the named counter and whether it exists
+func (cs *counterShards) get(name string) (uint64, bool) {
+	s := cs.shard(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if c, ok := s.counters[name]; ok {
+		return c.snap(false)
+	}
+	return 0, false
+}
+
+// len returns the number of counters with values
+func (cs *counterShards) len() int {
+	n := 0
+	for i := range cs {
+		s := &cs[i]
+		s.mu.RLock()
+		for _, c := range s.counters {
+			if atomic.LoadUint32(&c.touched) == 1 {
+				n++
+			}
+		}
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// remove stops tracking the named counter
+func (cs *counterShards) remove(name string) {
+	s := cs.shard(name)
+	s.mu.Lock()
+	delete(s.counters, name)
+	s.mu.Unlock()
+}
+
+// reset removes all counters
+func (cs *counterShards) reset() {
+	for i := range cs {
+		s := &cs[i]
+		s.mu.Lock()
+		s.counters = nil
+		s.mu.Unlock()
+	}
+}
+
+// snap copies the counter values into c, resetting them if reset is true.
+// Counters not updated since the previous flush are no longer tracked
+// (unless they are held instances from NewCounter).
+func (cs *counterShards) snap(c map[string]uint64, reset bool) {
+	for i := range cs {
+		s := &cs[i]
+		s.mu.Lock()
+		for n, ctr := range s.counters {
+			if v, ok := ctr.snap(reset); ok {
+				c[n] = v
+				continue
+			}
+			if reset && !ctr.pinned {
+				delete(s.counters, n)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// counter returns the named counter, creating it if needed. Caller must hold the lock.
+func (s *counterShard) counter(name string) *Counter {
+	if c, ok := s.counters[name]; ok {
+		return c
+	}
+	if s.counters == nil {
+		s.counters = make(map[string]*Counter)
+	}
+	c := &Counter{name: name}
+	s.counters[name] = c
+	return c
+}
+
+// NewCounter returns a counter metric instance, the stream tagged metric
+// name is resolved once and updates to the counter do not take a lock.
+// The instance is retained when counters are reset on flush, so it can
+// be held and updated for the life of the application.
+func (m *CirconusMetrics) NewCounter(metric string, tags Tags) *Counter {
+	name := m.MetricNameWithStreamTags(metric, tags)
+
+	s := m.counters.shard(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.counter(name)
+	c.pinned = true
+
+	return c
+}
+
+// Name returns the name from a counter instance
+func (c *Counter) Name() string {
+	return c.name
+}
+
+// Inc increments a counter instance by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add updates a counter instance by supplied value
+func (c *Counter) Add(val uint64) {
+	atomic.AddUint64(&c.value, val)
+	atomic.StoreUint32(&c.touched, 1)
+}
+
+// set sets a counter instance to a specific value
+func (c *Counter) set(val uint64) {
+	atomic.StoreUint64(&c.value, val)
+	atomic.StoreUint32(&c.touched, 1)
+}
+
+// Value returns the current value of a counter instance
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// snap returns the value of the counter and whether it has been updated,
+// resetting the counter if reset is true
+func (c *Counter) snap(reset bool) (uint64, bool) {
+	if reset {
+		if atomic.SwapUint32(&c.touched, 0) == 0 {
+			return 0, false
+		}
+		return atomic.SwapUint64(&c.value, 0), true
+	}
+	if atomic.LoadUint32(&c.touched) == 0 {
+		return 0, false
+	}
+	return atomic.LoadUint64(&c.value), true
+}
 
 // IncrementWithTags counter by 1, with tags
 func (m *CirconusMetrics) IncrementWithTags(metric string, tags Tags) {
@@ -38,9 +229,9 @@ func (m *CirconusMetrics) SetWithTags(metric string, tags Tags, val uint64) {
 
 // Set a counter to specific value
 func (m *CirconusMetrics) Set(metric string, val uint64) {
-	m.cm.Lock()
-	defer m.cm.Unlock()
-	m.counters[metric] = val
+	m.counters.update(metric, func(c *Counter) {
+		c.set(val)
+	})
 }
 
 // AddWithTags updates counter metric with tags by supplied value
@@ -50,9 +241,9 @@ func (m *CirconusMetrics) AddWithTags(metric string, tags Tags, val uint64) {
 
 // Add updates counter by supplied value
 func (m *CirconusMetrics) Add(metric string, val uint64) {
-	m.cm.Lock()
-	defer m.cm.Unlock()
-	m.counters[metric] += val
+	m.counters.update(metric, func(c *Counter) {
+		c.Add(val)
+	})
 }
 
 // RemoveCounterWithTags removes the named counter metric with tags
@@ -62,17 +253,12 @@ func (m *CirconusMetrics) RemoveCounterWithTags(metric string, tags Tags) {
 
 // RemoveCounter removes the named counter
 func (m *CirconusMetrics) RemoveCounter(metric string) {
-	m.cm.Lock()
-	defer m.cm.Unlock()
-	delete(m.counters, metric)
+	m.counters.remove(metric)
 }
 
 // GetCounterTest returns the current value for a counter. (note: it is a function specifically for "testing", disable automatic submission during testing.)
 func (m *CirconusMetrics) GetCounterTest(metric string) (uint64, error) {
-	m.cm.Lock()
-	defer m.cm.Unlock()
-
-	if val, ok := m.counters[metric]; ok {
+	if val, ok := m.counters.get(metric); ok {
 		return val, nil
 	}
 
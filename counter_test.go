@@ -5,17 +5,20 @@
 package circonusgometrics
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
 func TestSet(t *testing.T) {
 	t.Log("Testing counter.Set")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	cm.Set("foo", 30)
 
-	val, ok := cm.counters["foo"]
+	val, ok := cm.counters.get("foo")
 	if !ok {
 		t.Errorf("Expected to find foo")
 	}
@@ -26,7 +29,7 @@ func TestSet(t *testing.T) {
 
 	cm.Set("foo", 10)
 
-	val, ok = cm.counters["foo"]
+	val, ok = cm.counters.get("foo")
 	if !ok {
 		t.Errorf("Expected to find foo")
 	}
@@ -39,7 +42,7 @@ func TestSet(t *testing.T) {
 func TestSetWithTags(t *testing.T) {
 	t.Log("Testing counter.SetWithTags")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	metricName := "foo"
 	tags := Tags{{"foo", "bar"}, {"baz", "qux"}}
@@ -47,9 +50,9 @@ func TestSetWithTags(t *testing.T) {
 
 	cm.SetWithTags(metricName, tags, 30)
 
-	val, ok := cm.counters[streamTagMetricName]
+	val, ok := cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 30 {
@@ -58,9 +61,9 @@ func TestSetWithTags(t *testing.T) {
 
 	cm.SetWithTags(metricName, tags, 10)
 
-	val, ok = cm.counters[streamTagMetricName]
+	val, ok = cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 10 {
@@ -71,11 +74,11 @@ func TestSetWithTags(t *testing.T) {
 func TestIncrement(t *testing.T) {
 	t.Log("Testing counter.Increment")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	cm.Increment("foo")
 
-	val, ok := cm.counters["foo"]
+	val, ok := cm.counters.get("foo")
 	if !ok {
 		t.Errorf("Expected to find foo")
 	}
@@ -88,7 +91,7 @@ func TestIncrement(t *testing.T) {
 func TestIncrementWithTags(t *testing.T) {
 	t.Log("Testing counter.IncrementWithTags")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	metricName := "foo"
 	tags := Tags{{"foo", "bar"}, {"baz", "qux"}}
@@ -96,9 +99,9 @@ func TestIncrementWithTags(t *testing.T) {
 
 	cm.IncrementWithTags(metricName, tags)
 
-	val, ok := cm.counters[streamTagMetricName]
+	val, ok := cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 1 {
@@ -109,11 +112,11 @@ func TestIncrementWithTags(t *testing.T) {
 func TestIncrementByValue(t *testing.T) {
 	t.Log("Testing counter.IncrementByValue")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	cm.IncrementByValue("foo", 10)
 
-	val, ok := cm.counters["foo"]
+	val, ok := cm.counters.get("foo")
 	if !ok {
 		t.Errorf("Expected to find foo")
 	}
@@ -126,7 +129,7 @@ func TestIncrementByValue(t *testing.T) {
 func TestIncrementByValueWithTags(t *testing.T) {
 	t.Log("Testing counter.IncrementByValueWithTags")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	metricName := "foo"
 	tags := Tags{{"foo", "bar"}, {"baz", "qux"}}
@@ -134,9 +137,9 @@ func TestIncrementByValueWithTags(t *testing.T) {
 
 	cm.IncrementByValueWithTags(metricName, tags, 10)
 
-	val, ok := cm.counters[streamTagMetricName]
+	val, ok := cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 10 {
@@ -147,12 +150,12 @@ func TestIncrementByValueWithTags(t *testing.T) {
 func TestAdd(t *testing.T) {
 	t.Log("Testing counter.Add")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	cm.Set("foo", 2)
 	cm.Add("foo", 3)
 
-	val, ok := cm.counters["foo"]
+	val, ok := cm.counters.get("foo")
 	if !ok {
 		t.Fatal("Expected to find foo")
 	}
@@ -165,7 +168,7 @@ func TestAdd(t *testing.T) {
 func TestAddWithTags(t *testing.T) {
 	t.Log("Testing counter.AddWithTags")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	metricName := "foo"
 	tags := Tags{{"foo", "bar"}, {"baz", "qux"}}
@@ -173,9 +176,9 @@ func TestAddWithTags(t *testing.T) {
 
 	cm.SetWithTags(metricName, tags, 30)
 
-	val, ok := cm.counters[streamTagMetricName]
+	val, ok := cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 30 {
@@ -184,9 +187,9 @@ func TestAddWithTags(t *testing.T) {
 
 	cm.AddWithTags(metricName, tags, 1)
 
-	val, ok = cm.counters[streamTagMetricName]
+	val, ok = cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 31 {
@@ -197,11 +200,11 @@ func TestAddWithTags(t *testing.T) {
 func TestRemoveCounter(t *testing.T) {
 	t.Log("Testing counter.RemoveCounter")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	cm.Increment("foo")
 
-	val, ok := cm.counters["foo"]
+	val, ok := cm.counters.get("foo")
 	if !ok {
 		t.Errorf("Expected to find foo")
 	}
@@ -212,7 +215,7 @@ func TestRemoveCounter(t *testing.T) {
 
 	cm.RemoveCounter("foo")
 
-	val, ok = cm.counters["foo"]
+	val, ok = cm.counters.get("foo")
 	if ok {
 		t.Errorf("Expected NOT to find foo")
 	}
@@ -225,7 +228,7 @@ func TestRemoveCounter(t *testing.T) {
 func TestRemoveCounterWithTags(t *testing.T) {
 	t.Log("Testing counter.RemoveCounterWithTags")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	metricName := "foo"
 	tags := Tags{{"foo", "bar"}, {"baz", "qux"}}
@@ -233,9 +236,9 @@ func TestRemoveCounterWithTags(t *testing.T) {
 
 	cm.IncrementWithTags(metricName, tags)
 
-	val, ok := cm.counters[streamTagMetricName]
+	val, ok := cm.counters.get(streamTagMetricName)
 	if !ok {
-		t.Fatalf("%s with %v tags not found (%s) (%#v)", metricName, tags, streamTagMetricName, cm.counters)
+		t.Fatalf("%s with %v tags not found (%s)", metricName, tags, streamTagMetricName)
 	}
 
 	if val != 1 {
@@ -244,7 +247,7 @@ func TestRemoveCounterWithTags(t *testing.T) {
 
 	cm.RemoveCounterWithTags(metricName, tags)
 
-	val, ok = cm.counters[streamTagMetricName]
+	val, ok = cm.counters.get(streamTagMetricName)
 	if ok {
 		t.Fatalf("expected NOT to find %s", streamTagMetricName)
 	}
@@ -373,7 +376,7 @@ func TestRemoveCounterFuncWithTags(t *testing.T) {
 func TestGetCounterTest(t *testing.T) {
 	t.Log("Testing counter.GetCounterTest")
 
-	cm := &CirconusMetrics{counters: make(map[string]uint64)}
+	cm := &CirconusMetrics{}
 
 	cm.Set("foo", 10)
 
@@ -391,3 +394,148 @@ func TestGetCounterTest(t *testing.T) {
 	}
 
 }
+
+func TestNewCounter(t *testing.T) {
+	t.Log("Testing counter.NewCounter")
+
+	cm := &CirconusMetrics{resetCounters: true}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("foo", tags)
+
+	c := cm.NewCounter("foo", tags)
+	if c.Name() != streamTagMetricName {
+		t.Fatalf("expected %s, got %s", streamTagMetricName, c.Name())
+	}
+	if c2 := cm.NewCounter("foo", tags); c2 != c {
+		t.Fatal("expected same counter instance")
+	}
+
+	if _, err := cm.GetCounterTest(streamTagMetricName); err == nil {
+		t.Fatal("expected error, counter not updated")
+	}
+
+	c.Inc()
+	c.Add(2)
+	cm.AddWithTags("foo", tags, 1)
+
+	val, err := cm.GetCounterTest(streamTagMetricName)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if val != 4 {
+		t.Fatalf("expected 4, got %d", val)
+	}
+
+	counters := cm.snapCounters()
+	if counters[streamTagMetricName] != 4 {
+		t.Fatalf("expected 4, got %d", counters[streamTagMetricName])
+	}
+
+	t.Log("reset")
+	{
+		counters := cm.snapCounters()
+		if _, ok := counters[streamTagMetricName]; ok {
+			t.Fatalf("expected counter to be reset, got %v", counters)
+		}
+		c.Inc()
+		counters = cm.snapCounters()
+		if counters[streamTagMetricName] != 1 {
+			t.Fatalf("expected 1, got %d", counters[streamTagMetricName])
+		}
+	}
+
+	t.Log("no reset")
+	{
+		cm.resetCounters = false
+		c.Inc()
+		for i := 0; i < 2; i++ {
+			counters := cm.snapCounters()
+			if counters[streamTagMetricName] != 1 {
+				t.Fatalf("expected 1, got %d", counters[streamTagMetricName])
+			}
+		}
+	}
+
+	t.Log("remove")
+	{
+		cm.RemoveCounter(streamTagMetricName)
+		counters := cm.snapCounters()
+		if _, ok := counters[streamTagMetricName]; ok {
+			t.Fatalf("expected counter to be removed, got %v", counters)
+		}
+	}
+}
+
+func TestCounterConcurrentAdd(t *testing.T) {
+	t.Log("Testing counter.Add concurrent with flush")
+
+	cm := &CirconusMetrics{resetCounters: true}
+
+	const workers = 8
+	const adds = 1000
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				cm.Increment("foo")
+				cm.Increment(fmt.Sprintf("bar%d", i))
+			}
+		}(i)
+	}
+
+	var total uint64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		total += cm.snapCounters()["foo"]
+	}
+
+	if total != workers*adds {
+		t.Fatalf("expected %d, got %d", workers*adds, total)
+	}
+
+	if n := cm.counters.len(); n != 0 {
+		t.Fatalf("expected 0 counters with values, got %d", n)
+	}
+
+	cm.snapCounters()
+	if _, ok := cm.counters.get("bar0"); ok {
+		t.Fatal("expected untouched counter to be removed")
+	}
+}
+
+func BenchmarkIncrementParallel(b *testing.B) {
+	cm := &CirconusMetrics{}
+	var id uint64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		metric := fmt.Sprintf("foo%d", atomic.AddUint64(&id, 1))
+		for pb.Next() {
+			cm.Increment(metric)
+		}
+	})
+}
+
+func BenchmarkIncrementParallelShared(b *testing.B) {
+	cm := &CirconusMetrics{}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cm.Increment("foo")
+		}
+	})
+}
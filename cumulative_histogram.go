@@ -0,0 +1,105 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"time"
+
+	"github.com/openhistogram/circonusllhist"
+	"github.com/pkg/errors"
+)
+
+// Cumulative histograms are never reset, each submission contains every
+// value recorded since the histogram was created (type "H"). The broker
+// derives the distribution for each period from the difference between
+// submissions, so late or duplicate submissions are idempotent. They are
+// not affected by ResetHistograms.
+
+// SetCumulativeHistogramValueWithTags adds a value to a cumulative histogram metric with tags
+func (m *CirconusMetrics) SetCumulativeHistogramValueWithTags(metric string, tags Tags, val float64) {
+	m.SetCumulativeHistogramValue(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// SetCumulativeHistogramValue adds a value to a cumulative histogram
+func (m *CirconusMetrics) SetCumulativeHistogramValue(metric string, val float64) {
+	err := m.recordHistogram(metric, true, func(h *circonusllhist.Histogram) error {
+		return h.RecordValue(val)
+	})
+	if err != nil {
+		m.Log.Printf("error recording cumulative histogram value (%v)\n", err)
+	}
+}
+
+// SetCumulativeHistogramDurationWithTags adds a time.Duration to a cumulative histogram metric with tags
+func (m *CirconusMetrics) SetCumulativeHistogramDurationWithTags(metric string, tags Tags, val time.Duration) {
+	m.SetCumulativeHistogramDuration(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// SetCumulativeHistogramDuration adds a time.Duration to a cumulative histogram
+// (duration is normalized to time.Second, but supports nanosecond granularity).
+func (m *CirconusMetrics) SetCumulativeHistogramDuration(metric string, val time.Duration) {
+	err := m.recordHistogram(metric, true, func(h *circonusllhist.Histogram) error {
+		return h.RecordDuration(val)
+	})
+	if err != nil {
+		m.Log.Printf("error recording cumulative histogram duration (%v)\n", err)
+	}
+}
+
+// RecordCountForValueCumulativeWithTags adds count n for value to a cumulative histogram metric with tags
+func (m *CirconusMetrics) RecordCountForValueCumulativeWithTags(metric string, tags Tags, val float64, n int64) {
+	m.RecordCountForValueCumulative(m.MetricNameWithStreamTags(metric, tags), val, n)
+}
+
+// RecordCountForValueCumulative adds count n for value to a cumulative histogram
+func (m *CirconusMetrics) RecordCountForValueCumulative(metric string, val float64, n int64) {
+	err := m.recordHistogram(metric, true, func(h *circonusllhist.Histogram) error {
+		return h.RecordValues(val, n)
+	})
+	if err != nil {
+		m.Log.Printf("error recording cumulative histogram values (%v)\n", err)
+	}
+}
+
+// NewCumulativeHistogramWithTags returns a cumulative histogram metric with tags instance
+func (m *CirconusMetrics) NewCumulativeHistogramWithTags(metric string, tags Tags) *Histogram {
+	return m.NewCumulativeHistogram(m.MetricNameWithStreamTags(metric, tags))
+}
+
+// NewCumulativeHistogram returns a cumulative histogram instance
+func (m *CirconusMetrics) NewCumulativeHistogram(metric string) *Histogram {
+	return m.histogram(metric, true)
+}
+
+// RemoveCumulativeHistogramWithTags removes a cumulative histogram metric with tags
+func (m *CirconusMetrics) RemoveCumulativeHistogramWithTags(metric string, tags Tags) {
+	m.RemoveCumulativeHistogram(m.MetricNameWithStreamTags(metric, tags))
+}
+
+// RemoveCumulativeHistogram removes a cumulative histogram
+func (m *CirconusMetrics) RemoveCumulativeHistogram(metric string) {
+	m.hm.Lock()
+	defer m.hm.Unlock()
+	if hist, ok := m.cumulativeHistograms[metric]; ok {
+		hist.rw.Lock()
+		hist.removed = true
+		hist.rw.Unlock()
+		delete(m.cumulativeHistograms, metric)
+	}
+}
+
+// GetCumulativeHistogramTest returns the current value for a cumulative histogram. (note: it is a function specifically for "testing", disable automatic submission during testing.)
+func (m *CirconusMetrics) GetCumulativeHistogramTest(metric string) ([]string, error) {
+	m.hm.RLock()
+	defer m.hm.RUnlock()
+
+	if hist, ok := m.cumulativeHistograms[metric]; ok {
+		hist.rw.Lock()
+		defer hist.rw.Unlock()
+		return hist.hist.DecStrings(), nil
+	}
+
+	return []string{""}, errors.Errorf("Cumulative histogram metric '%s' not found", metric)
+}
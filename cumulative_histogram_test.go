@@ -0,0 +1,122 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetCumulativeHistogramValue(t *testing.T) {
+	t.Log("Testing cumulative_histogram.SetCumulativeHistogramValue")
+
+	cm := &CirconusMetrics{resetHistograms: true}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("bar", tags)
+
+	cm.SetCumulativeHistogramValue("foo", 1)
+	cm.SetCumulativeHistogramDurationWithTags("bar", tags, time.Second)
+	cm.RecordCountForValueCumulative("foo", 1, 2)
+
+	val, err := cm.GetCumulativeHistogramTest("foo")
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if len(val) != 1 || val[0] != "H[1.0e+00]=3" {
+		t.Fatalf("expected [H[1.0e+00]=3], got %v", val)
+	}
+
+	if _, err := cm.GetCumulativeHistogramTest(streamTagMetricName); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if _, err := cm.GetHistogramTest("foo"); err == nil {
+		t.Fatal("expected error, cumulative histogram is not a histogram")
+	}
+
+	cm.RemoveCumulativeHistogram("foo")
+	cm.RemoveCumulativeHistogramWithTags("bar", tags)
+
+	if _, err := cm.GetCumulativeHistogramTest("foo"); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := cm.GetCumulativeHistogramTest(streamTagMetricName); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNewCumulativeHistogram(t *testing.T) {
+	t.Log("Testing cumulative_histogram.NewCumulativeHistogram")
+
+	cm := &CirconusMetrics{resetHistograms: true}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("foo", tags)
+
+	h := cm.NewCumulativeHistogramWithTags("foo", tags)
+	if h.Name() != streamTagMetricName {
+		t.Fatalf("expected %s, got %s", streamTagMetricName, h.Name())
+	}
+	if h2 := cm.NewCumulativeHistogram(streamTagMetricName); h2 != h {
+		t.Fatal("expected same histogram instance")
+	}
+
+	h.RecordValue(1)
+	cm.SetCumulativeHistogramValueWithTags("foo", tags, 1)
+
+	for i := 0; i < 2; i++ {
+		hists := cm.snapCumulativeHistograms()
+		if c := hists[streamTagMetricName].Count(); c != 2 {
+			t.Fatalf("expected 2 samples, got %d", c)
+		}
+	}
+}
+
+func TestCumulativeHistogramOutput(t *testing.T) {
+	t.Log("Testing cumulative histogram packaging")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cfg.ResetHistograms = "true"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cm.SetCumulativeHistogramValue("foo", 1)
+	cm.SetHistogramValue("bar", 1)
+
+	metrics := cm.FlushMetrics()
+	if m, ok := (*metrics)["foo"]; !ok || m.Type != MetricTypeCumulativeHistogram {
+		t.Fatalf("expected foo of type H, got %#v", (*metrics)["foo"])
+	}
+	if m, ok := (*metrics)["bar"]; !ok || m.Type != MetricTypeHistogram {
+		t.Fatalf("expected bar of type h, got %#v", (*metrics)["bar"])
+	}
+	first := (*metrics)["foo"].Value
+
+	cm.SetCumulativeHistogramValue("foo", 2)
+
+	metrics = cm.FlushMetrics()
+	if m, ok := (*metrics)["foo"]; !ok || m.Value == first {
+		t.Fatalf("expected foo with both samples, got %#v", (*metrics)["foo"])
+	}
+
+	metrics = cm.FlushMetrics()
+	if _, ok := (*metrics)["foo"]; !ok {
+		t.Fatal("expected foo, cumulative histograms are not reset")
+	}
+	if _, ok := (*metrics)["bar"]; ok {
+		t.Fatal("expected bar to be reset")
+	}
+
+	cm.Reset()
+	if metrics := cm.FlushMetrics(); len(*metrics) != 0 {
+		t.Fatalf("expected no metrics after reset, got %v", *metrics)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package expvarmetrics publishes variables exported with the standard
+// library expvar package (/debug/vars) to circonus-gometrics.
+package expvarmetrics
+
+import (
+	"context"
+	"expvar"
+	"regexp"
+	"strconv"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPrefix = "expvar"
+	tagCategory   = "key"
+)
+
+// Options for the expvar collector
+type Options struct {
+	// Prefix for metric names, default "expvar". The prefix also names the
+	// collector, register with distinct prefixes to publish different sets
+	// of variables.
+	Prefix string
+
+	// Include and Exclude are regular expressions matched against the
+	// dotted name of each variable (e.g. "requests.GET"), a variable is
+	// published if it matches any Include pattern (or no Include patterns
+	// are set) and does not match any Exclude pattern.
+	Include []string
+	Exclude []string
+
+	// StreamTags flattens nested maps into stream tags rather than dotted
+	// metric names, e.g. requests|ST[key:GET] rather than requests.GET.
+	// The tag category of the first level of nesting is "key", deeper
+	// levels are "key2", "key3", etc.
+	StreamTags bool
+
+	// Tags added to each published variable, alongside the key tags when
+	// StreamTags is set
+	Tags cgm.Tags
+}
+
+// Metrics published (each tagged with the Options.Tags):
+//
+//   <prefix>.<name>[.<key>...]    gauge (int64), expvar.Int
+//                                 gauge (float64), expvar.Float
+//                                 text, expvar.String
+//
+// Variables of any other type are skipped, including expvar.Func (e.g. the
+// memstats and cmdline variables published by the expvar package) which may
+// be expensive to evaluate.
+
+// collector walks the expvar variables at each flush
+type collector struct {
+	prefix     string
+	include    []*regexp.Regexp
+	exclude    []*regexp.Regexp
+	tags       cgm.Tags
+	streamTags bool
+}
+
+// Register registers a collector publishing the expvar variables at each
+// flush, an error is returned if an Include or Exclude pattern is invalid.
+func Register(m *cgm.CirconusMetrics, opts *Options) error {
+	o := options(opts)
+
+	c := &collector{
+		prefix:     o.Prefix,
+		tags:       o.Tags,
+		streamTags: o.StreamTags,
+	}
+
+	var err error
+	if c.include, err = compile(o.Include); err != nil {
+		return errors.Wrap(err, "parsing include pattern")
+	}
+	if c.exclude, err = compile(o.Exclude); err != nil {
+		return errors.Wrap(err, "parsing exclude pattern")
+	}
+
+	m.RegisterCollector(o.Prefix, c, 0)
+
+	return nil
+}
+
+// Unregister stops publishing the variables registered with the same Prefix.
+func Unregister(m *cgm.CirconusMetrics, opts *Options) {
+	o := options(opts)
+	m.UnregisterCollector(o.Prefix)
+}
+
+func options(opts *Options) Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = defaultPrefix
+	}
+	return o
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Collect implements cgm.Collector
+func (c *collector) Collect(ctx context.Context, e *cgm.Emitter) error {
+	expvar.Do(func(kv expvar.KeyValue) {
+		if ctx.Err() != nil {
+			return
+		}
+		c.emit(e, kv.Key, c.prefix+"."+kv.Key, c.tags, 0, kv.Value)
+	})
+	return ctx.Err()
+}
+
+// emit publishes a variable, path is the dotted name used for filtering,
+// name and tags are the metric name and tags, level is the map nesting level
+func (c *collector) emit(e *cgm.Emitter, path, name string, tags cgm.Tags, level int, v expvar.Var) {
+	if m, ok := v.(*expvar.Map); ok {
+		m.Do(func(kv expvar.KeyValue) {
+			if c.streamTags {
+				c.emit(e, path+"."+kv.Key, name, withTag(tags, level, kv.Key), level+1, kv.Value)
+				return
+			}
+			c.emit(e, path+"."+kv.Key, name+"."+kv.Key, tags, level+1, kv.Value)
+		})
+		return
+	}
+
+	if !c.match(path) {
+		return
+	}
+
+	switch tv := v.(type) {
+	case *expvar.Int:
+		e.SetGauge(name, tags, tv.Value())
+	case *expvar.Float:
+		e.SetGauge(name, tags, tv.Value())
+	case *expvar.String:
+		e.SetText(name, tags, tv.Value())
+	}
+}
+
+// match returns whether a variable passes the include and exclude patterns
+func (c *collector) match(path string) bool {
+	for _, re := range c.exclude {
+		if re.MatchString(path) {
+			return false
+		}
+	}
+	if len(c.include) == 0 {
+		return true
+	}
+	for _, re := range c.include {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// withTag returns a copy of tags with the map key of a nesting level appended
+func withTag(tags cgm.Tags, level int, key string) cgm.Tags {
+	category := tagCategory
+	if level > 0 {
+		category += strconv.Itoa(level + 1)
+	}
+	t := make(cgm.Tags, len(tags), len(tags)+1)
+	copy(t, tags)
+	return append(t, cgm.Tag{Category: category, Value: key})
+}
@@ -0,0 +1,143 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package expvarmetrics
+
+import (
+	"expvar"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+func init() {
+	expvar.NewInt("evtest_int").Set(10)
+	expvar.NewFloat("evtest_float").Set(1.5)
+	expvar.NewString("evtest_string").Set("hello")
+
+	requests := expvar.NewMap("evtest_requests")
+	requests.Add("GET", 3)
+	requests.AddFloat("latency", 0.25)
+	status := new(expvar.Map).Init()
+	status.Add("200", 2)
+	status.Add("500", 1)
+	requests.Set("status", status)
+
+	expvar.Publish("evtest_func", expvar.Func(func() interface{} { return 1 }))
+}
+
+func TestRegister(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	tags := cgm.Tags{{Category: "app", Value: "test"}}
+	opts := &Options{
+		Include: []string{`^evtest_`},
+		Exclude: []string{`\.500$`},
+		Tags:    tags,
+	}
+	if err := Register(cm, opts); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output := *cm.FlushMetrics()
+
+	expected := map[string]interface{}{
+		"expvar.evtest_int":                 int64(10),
+		"expvar.evtest_float":               float64(1.5),
+		"expvar.evtest_string":              "hello",
+		"expvar.evtest_requests.GET":        int64(3),
+		"expvar.evtest_requests.latency":    float64(0.25),
+		"expvar.evtest_requests.status.200": int64(2),
+	}
+
+	for name, value := range expected {
+		mn := cm.MetricNameWithStreamTags(name, tags)
+		m, ok := output[mn]
+		if !ok {
+			t.Fatalf("expected %s in output", mn)
+		}
+		if m.Value != value {
+			t.Fatalf("%s expected %v (%T), got %v (%T)", name, value, value, m.Value, m.Value)
+		}
+	}
+
+	for _, name := range []string{"expvar.evtest_requests.status.500", "expvar.evtest_func", "expvar.memstats", "expvar.cmdline"} {
+		if _, ok := output[cm.MetricNameWithStreamTags(name, tags)]; ok {
+			t.Fatalf("expected %s not to be published", name)
+		}
+	}
+
+	Unregister(cm, opts)
+	if output := *cm.FlushMetrics(); len(output) != 0 {
+		t.Fatalf("expected no metrics after unregister, got %v", output)
+	}
+}
+
+func TestRegisterStreamTags(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	opts := &Options{
+		Prefix:     "vars",
+		Include:    []string{`^evtest_requests\.`},
+		StreamTags: true,
+	}
+	if err := Register(cm, opts); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output := *cm.FlushMetrics()
+
+	expected := map[string]interface{}{
+		cm.MetricNameWithStreamTags("vars.evtest_requests", cgm.Tags{{Category: "key", Value: "GET"}}):                                      int64(3),
+		cm.MetricNameWithStreamTags("vars.evtest_requests", cgm.Tags{{Category: "key", Value: "latency"}}):                                  float64(0.25),
+		cm.MetricNameWithStreamTags("vars.evtest_requests", cgm.Tags{{Category: "key", Value: "status"}, {Category: "key2", Value: "200"}}): int64(2),
+		cm.MetricNameWithStreamTags("vars.evtest_requests", cgm.Tags{{Category: "key", Value: "status"}, {Category: "key2", Value: "500"}}): int64(1),
+	}
+
+	// plus the collector duration
+	if len(output) != len(expected)+1 {
+		t.Fatalf("expected %d metrics, got %d (%v)", len(expected)+1, len(output), output)
+	}
+	for name, value := range expected {
+		m, ok := output[name]
+		if !ok {
+			t.Fatalf("expected %s in output", name)
+		}
+		if m.Value != value {
+			t.Fatalf("%s expected %v, got %v", name, value, m.Value)
+		}
+	}
+}
+
+func TestRegisterInvalidPattern(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if err := Register(cm, &Options{Include: []string{"("}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := Register(cm, &Options{Exclude: []string{"("}}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -4,12 +4,86 @@
 
 package circonusgometrics
 
-import "github.com/pkg/errors"
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
 
 // A Gauge is an instantaneous measurement of a value.
 //
 // Use a gauge to track metrics which increase and decrease (e.g., amount of
 // free memory).
+type Gauge struct {
+	value   int64  // atomic
+	touched uint32 // atomic, gauge updated since last flush
+	name    string
+}
+
+// NewGauge returns a gauge metric instance, the stream tagged metric
+// name is resolved once and updates to the gauge do not take a lock.
+func (m *CirconusMetrics) NewGauge(metric string, tags Tags) *Gauge {
+	name := m.MetricNameWithStreamTags(metric, tags)
+
+	m.gm.Lock()
+	defer m.gm.Unlock()
+
+	if m.gaugeHandles == nil {
+		m.gaugeHandles = make(map[string]*Gauge)
+	}
+
+	if g, ok := m.gaugeHandles[name]; ok {
+		return g
+	}
+
+	g := &Gauge{name: name}
+	m.gaugeHandles[name] = g
+
+	return g
+}
+
+// Name returns the name from a gauge instance
+func (g *Gauge) Name() string {
+	return g.name
+}
+
+// Set sets a gauge instance to a value
+func (g *Gauge) Set(val int64) {
+	atomic.StoreInt64(&g.value, val)
+	atomic.StoreUint32(&g.touched, 1)
+}
+
+// Add adds value to a gauge instance
+func (g *Gauge) Add(val int64) {
+	atomic.AddInt64(&g.value, val)
+	atomic.StoreUint32(&g.touched, 1)
+}
+
+// Sub subtracts value from a gauge instance
+func (g *Gauge) Sub(val int64) {
+	g.Add(-val)
+}
+
+// Value returns the current value of a gauge instance
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// snap returns the value of the gauge and whether it has been updated,
+// resetting the gauge if reset is true
+func (g *Gauge) snap(reset bool) (int64, bool) {
+	if reset {
+		if atomic.SwapUint32(&g.touched, 0) == 0 {
+			return 0, false
+		}
+		return atomic.SwapInt64(&g.value, 0), true
+	}
+	if atomic.LoadUint32(&g.touched) == 0 {
+		return 0, false
+	}
+	return atomic.LoadInt64(&g.value), true
+}
 
 // GaugeWithTags sets a gauge metric with tags to a value
 func (m *CirconusMetrics) GaugeWithTags(metric string, tags Tags, val interface{}) {
@@ -26,8 +100,14 @@ func (m *CirconusMetrics) SetGaugeWithTags(metric string, tags Tags, val interfa
 	m.SetGauge(m.MetricNameWithStreamTags(metric, tags), val)
 }
 
-// SetGauge sets a gauge to a value
+// SetGauge sets a gauge to a value, values of unsupported (non-numeric)
+// types are logged and the gauge is left unchanged.
 func (m *CirconusMetrics) SetGauge(metric string, val interface{}) {
+	if _, err := widenGaugeValue(val); err != nil {
+		m.Log.Printf("[WARN] setting gauge %s: %s", metric, err)
+		return
+	}
+
 	m.gm.Lock()
 	defer m.gm.Unlock()
 	m.gauges[metric] = val
@@ -38,45 +118,232 @@ func (m *CirconusMetrics) AddGaugeWithTags(metric string, tags Tags, val interfa
 	m.AddGauge(m.MetricNameWithStreamTags(metric, tags), val)
 }
 
-// AddGauge adds value to existing gauge
+// AddGauge adds value to existing gauge. Values of the same type are added
+// retaining the type, mixed types are added as float64 if either value is
+// a float, uint64 if both values are unsigned, otherwise int64 (float64 if
+// an unsigned value exceeds the int64 range). Unsupported types are logged
+// and the gauge is left unchanged.
 func (m *CirconusMetrics) AddGauge(metric string, val interface{}) {
 	m.gm.Lock()
 	defer m.gm.Unlock()
 
 	v, ok := m.gauges[metric]
 	if !ok {
+		if _, err := widenGaugeValue(val); err != nil {
+			m.Log.Printf("[WARN] adding to gauge %s: %s", metric, err)
+			return
+		}
 		m.gauges[metric] = val
 		return
 	}
 
+	sum, err := addGaugeValues(v, val)
+	if err != nil {
+		m.Log.Printf("[WARN] adding to gauge %s: %s", metric, err)
+		return
+	}
+
+	m.gauges[metric] = sum
+}
+
+// SetGaugeInt64WithTags sets a gauge metric with tags to an int64 value
+func (m *CirconusMetrics) SetGaugeInt64WithTags(metric string, tags Tags, val int64) {
+	m.SetGaugeInt64(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// SetGaugeInt64 sets a gauge to an int64 value
+func (m *CirconusMetrics) SetGaugeInt64(metric string, val int64) {
+	m.SetGauge(metric, val)
+}
+
+// SetGaugeUint64WithTags sets a gauge metric with tags to a uint64 value
+func (m *CirconusMetrics) SetGaugeUint64WithTags(metric string, tags Tags, val uint64) {
+	m.SetGaugeUint64(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// SetGaugeUint64 sets a gauge to a uint64 value
+func (m *CirconusMetrics) SetGaugeUint64(metric string, val uint64) {
+	m.SetGauge(metric, val)
+}
+
+// SetGaugeFloat64WithTags sets a gauge metric with tags to a float64 value
+func (m *CirconusMetrics) SetGaugeFloat64WithTags(metric string, tags Tags, val float64) {
+	m.SetGaugeFloat64(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// SetGaugeFloat64 sets a gauge to a float64 value
+func (m *CirconusMetrics) SetGaugeFloat64(metric string, val float64) {
+	m.SetGauge(metric, val)
+}
+
+// AddGaugeInt64WithTags adds an int64 value to existing gauge metric with tags
+func (m *CirconusMetrics) AddGaugeInt64WithTags(metric string, tags Tags, val int64) {
+	m.AddGaugeInt64(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// AddGaugeInt64 adds an int64 value to existing gauge, see AddGauge for
+// how values of differing types are added
+func (m *CirconusMetrics) AddGaugeInt64(metric string, val int64) {
+	m.AddGauge(metric, val)
+}
+
+// AddGaugeUint64WithTags adds a uint64 value to existing gauge metric with tags
+func (m *CirconusMetrics) AddGaugeUint64WithTags(metric string, tags Tags, val uint64) {
+	m.AddGaugeUint64(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// AddGaugeUint64 adds a uint64 value to existing gauge, see AddGauge for
+// how values of differing types are added
+func (m *CirconusMetrics) AddGaugeUint64(metric string, val uint64) {
+	m.AddGauge(metric, val)
+}
+
+// AddGaugeFloat64WithTags adds a float64 value to existing gauge metric with tags
+func (m *CirconusMetrics) AddGaugeFloat64WithTags(metric string, tags Tags, val float64) {
+	m.AddGaugeFloat64(m.MetricNameWithStreamTags(metric, tags), val)
+}
+
+// AddGaugeFloat64 adds a float64 value to existing gauge, see AddGauge for
+// how values of differing types are added
+func (m *CirconusMetrics) AddGaugeFloat64(metric string, val float64) {
+	m.AddGauge(metric, val)
+}
+
+// addGaugeValues returns the sum of two gauge values
+func addGaugeValues(v, val interface{}) (interface{}, error) {
 	switch vnew := val.(type) {
-	default:
-		// ignore it, unsupported type
 	case int:
-		m.gauges[metric] = v.(int) + vnew
+		if vcur, ok := v.(int); ok {
+			return vcur + vnew, nil
+		}
+	case int8:
+		if vcur, ok := v.(int8); ok {
+			return vcur + vnew, nil
+		}
+	case int16:
+		if vcur, ok := v.(int16); ok {
+			return vcur + vnew, nil
+		}
+	case int32:
+		if vcur, ok := v.(int32); ok {
+			return vcur + vnew, nil
+		}
+	case int64:
+		if vcur, ok := v.(int64); ok {
+			return vcur + vnew, nil
+		}
+	case uint:
+		if vcur, ok := v.(uint); ok {
+			return vcur + vnew, nil
+		}
+	case uint8:
+		if vcur, ok := v.(uint8); ok {
+			return vcur + vnew, nil
+		}
+	case uint16:
+		if vcur, ok := v.(uint16); ok {
+			return vcur + vnew, nil
+		}
+	case uint32:
+		if vcur, ok := v.(uint32); ok {
+			return vcur + vnew, nil
+		}
+	case uint64:
+		if vcur, ok := v.(uint64); ok {
+			return vcur + vnew, nil
+		}
+	case float32:
+		if vcur, ok := v.(float32); ok {
+			return vcur + vnew, nil
+		}
+	case float64:
+		if vcur, ok := v.(float64); ok {
+			return vcur + vnew, nil
+		}
+	}
+
+	// differing types, widen both values
+	a, err := widenGaugeValue(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "current value")
+	}
+	b, err := widenGaugeValue(val)
+	if err != nil {
+		return nil, errors.Wrap(err, "new value")
+	}
+
+	switch av := a.(type) {
+	case float64:
+		return av + toFloat64(b), nil
+	case uint64:
+		switch bv := b.(type) {
+		case uint64:
+			return av + bv, nil
+		case int64:
+			if av > math.MaxInt64 {
+				return float64(av) + float64(bv), nil
+			}
+			return int64(av) + bv, nil
+		default:
+			return float64(av) + toFloat64(b), nil
+		}
+	default: // int64
+		switch bv := b.(type) {
+		case int64:
+			return av.(int64) + bv, nil
+		case uint64:
+			if bv > math.MaxInt64 {
+				return toFloat64(a) + float64(bv), nil
+			}
+			return av.(int64) + int64(bv), nil
+		default:
+			return toFloat64(a) + toFloat64(b), nil
+		}
+	}
+}
+
+// widenGaugeValue converts a numeric gauge value to int64, uint64 or float64
+func widenGaugeValue(v interface{}) (interface{}, error) {
+	switch tv := v.(type) {
+	case int:
+		return int64(tv), nil
 	case int8:
-		m.gauges[metric] = v.(int8) + vnew
+		return int64(tv), nil
 	case int16:
-		m.gauges[metric] = v.(int16) + vnew
+		return int64(tv), nil
 	case int32:
-		m.gauges[metric] = v.(int32) + vnew
+		return int64(tv), nil
 	case int64:
-		m.gauges[metric] = v.(int64) + vnew
+		return tv, nil
 	case uint:
-		m.gauges[metric] = v.(uint) + vnew
+		return uint64(tv), nil
 	case uint8:
-		m.gauges[metric] = v.(uint8) + vnew
+		return uint64(tv), nil
 	case uint16:
-		m.gauges[metric] = v.(uint16) + vnew
+		return uint64(tv), nil
 	case uint32:
-		m.gauges[metric] = v.(uint32) + vnew
+		return uint64(tv), nil
 	case uint64:
-		m.gauges[metric] = v.(uint64) + vnew
+		return tv, nil
 	case float32:
-		m.gauges[metric] = v.(float32) + vnew
+		return float64(tv), nil
 	case float64:
-		m.gauges[metric] = v.(float64) + vnew
+		return tv, nil
 	}
+	return nil, errors.Errorf("unsupported type %T", v)
+}
+
+// toFloat64 converts a widened gauge value to float64
+func toFloat64(v interface{}) float64 {
+	switch tv := v.(type) {
+	case int64:
+		return float64(tv)
+	case uint64:
+		return float64(tv)
+	case float64:
+		return tv
+	}
+	return 0
 }
 
 // RemoveGaugeWithTags removes a gauge metric with tags
@@ -89,6 +356,7 @@ func (m *CirconusMetrics) RemoveGauge(metric string) {
 	m.gm.Lock()
 	defer m.gm.Unlock()
 	delete(m.gauges, metric)
+	delete(m.gaugeHandles, metric)
 }
 
 // GetGaugeTest returns the current value for a gauge. (note: it is a function specifically for "testing", disable automatic submission during testing.)
@@ -96,6 +364,12 @@ func (m *CirconusMetrics) GetGaugeTest(metric string) (interface{}, error) {
 	m.gm.Lock()
 	defer m.gm.Unlock()
 
+	if g, ok := m.gaugeHandles[metric]; ok {
+		if v, touched := g.snap(false); touched {
+			return v, nil
+		}
+	}
+
 	if val, ok := m.gauges[metric]; ok {
 		return val, nil
 	}
@@ -112,9 +386,45 @@ func (m *CirconusMetrics) SetGaugeFuncWithTags(metric string, tags Tags, fn func
 func (m *CirconusMetrics) SetGaugeFunc(metric string, fn func() int64) {
 	m.gfm.Lock()
 	defer m.gfm.Unlock()
+	m.removeGaugeFunc(metric)
+	if m.gaugeFuncs == nil {
+		m.gaugeFuncs = make(map[string]func() int64)
+	}
 	m.gaugeFuncs[metric] = fn
 }
 
+// SetGaugeFuncFloat64WithTags sets a gauge metric with tags to a float64 function [called at flush interval]
+func (m *CirconusMetrics) SetGaugeFuncFloat64WithTags(metric string, tags Tags, fn func() float64) {
+	m.SetGaugeFuncFloat64(m.MetricNameWithStreamTags(metric, tags), fn)
+}
+
+// SetGaugeFuncFloat64 sets a gauge to a float64 function [called at flush interval]
+func (m *CirconusMetrics) SetGaugeFuncFloat64(metric string, fn func() float64) {
+	m.gfm.Lock()
+	defer m.gfm.Unlock()
+	m.removeGaugeFunc(metric)
+	if m.gaugeFloat64Funcs == nil {
+		m.gaugeFloat64Funcs = make(map[string]func() float64)
+	}
+	m.gaugeFloat64Funcs[metric] = fn
+}
+
+// SetGaugeFuncUint64WithTags sets a gauge metric with tags to a uint64 function [called at flush interval]
+func (m *CirconusMetrics) SetGaugeFuncUint64WithTags(metric string, tags Tags, fn func() uint64) {
+	m.SetGaugeFuncUint64(m.MetricNameWithStreamTags(metric, tags), fn)
+}
+
+// SetGaugeFuncUint64 sets a gauge to a uint64 function [called at flush interval]
+func (m *CirconusMetrics) SetGaugeFuncUint64(metric string, fn func() uint64) {
+	m.gfm.Lock()
+	defer m.gfm.Unlock()
+	m.removeGaugeFunc(metric)
+	if m.gaugeUint64Funcs == nil {
+		m.gaugeUint64Funcs = make(map[string]func() uint64)
+	}
+	m.gaugeUint64Funcs[metric] = fn
+}
+
 // RemoveGaugeFuncWithTags removes a gauge metric with tags function
 func (m *CirconusMetrics) RemoveGaugeFuncWithTags(metric string, tags Tags) {
 	m.RemoveGaugeFunc(m.MetricNameWithStreamTags(metric, tags))
@@ -124,7 +434,15 @@ func (m *CirconusMetrics) RemoveGaugeFuncWithTags(metric string, tags Tags) {
 func (m *CirconusMetrics) RemoveGaugeFunc(metric string) {
 	m.gfm.Lock()
 	defer m.gfm.Unlock()
+	m.removeGaugeFunc(metric)
+}
+
+// removeGaugeFunc removes a gauge function of any type, a metric has
+// at most one gauge function. Caller must hold the lock.
+func (m *CirconusMetrics) removeGaugeFunc(metric string) {
 	delete(m.gaugeFuncs, metric)
+	delete(m.gaugeFloat64Funcs, metric)
+	delete(m.gaugeUint64Funcs, metric)
 }
 
 // getGaugeType returns accurate resmon type for underlying type of gauge value
@@ -151,6 +469,10 @@ func (m *CirconusMetrics) getGaugeType(v interface{}) string {
 		mt = "l"
 	case uint64:
 		mt = "L"
+	case float32:
+		mt = "n"
+	case float64:
+		mt = "n"
 	}
 
 	return mt
@@ -5,6 +5,10 @@
 package circonusgometrics
 
 import (
+	"bytes"
+	"log"
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -539,6 +543,35 @@ func TestSetGaugeWithTags(t *testing.T) {
 	}
 }
 
+func TestSetGaugeUnsupported(t *testing.T) {
+	t.Log("Testing gauge.SetGauge unsupported types")
+
+	var buf bytes.Buffer
+	cm := &CirconusMetrics{
+		gauges: make(map[string]interface{}),
+		Log:    log.New(&buf, "", 0),
+	}
+
+	cm.SetGauge("foo", "10")
+	cm.SetGaugeWithTags("bar", Tags{{"foo", "bar"}}, struct{}{})
+	cm.AddGauge("baz", []int{1})
+
+	if len(cm.gauges) != 0 {
+		t.Fatalf("expected no gauges, got %v", cm.gauges)
+	}
+	for _, typ := range []string{"string", "struct {}", "[]int"} {
+		if !strings.Contains(buf.String(), "unsupported type "+typ) {
+			t.Fatalf("expected unsupported type %s to be logged, got %q", typ, buf.String())
+		}
+	}
+
+	cm.SetGauge("foo", 10)
+	cm.SetGauge("foo", "20")
+	if val := cm.gauges["foo"]; val != 10 {
+		t.Fatalf("expected 10, got %v", val)
+	}
+}
+
 func TestGetGaugeTest(t *testing.T) {
 	t.Log("Testing gauge.GetGaugeTest")
 
@@ -737,3 +770,232 @@ func TestRemoveGaugeFuncWithTags(t *testing.T) {
 	}
 
 }
+
+func TestNewGauge(t *testing.T) {
+	t.Log("Testing gauge.NewGauge")
+
+	cm := &CirconusMetrics{gauges: make(map[string]interface{}), resetGauges: true}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("foo", tags)
+
+	g := cm.NewGauge("foo", tags)
+	if g.Name() != streamTagMetricName {
+		t.Fatalf("expected %s, got %s", streamTagMetricName, g.Name())
+	}
+	if g2 := cm.NewGauge("foo", tags); g2 != g {
+		t.Fatal("expected same gauge instance")
+	}
+
+	g.Set(10)
+	g.Add(5)
+	g.Sub(3)
+
+	val, err := cm.GetGaugeTest(streamTagMetricName)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if val.(int64) != 12 {
+		t.Fatalf("expected 12, got %v", val)
+	}
+
+	gauges := cm.snapGauges()
+	if gauges[streamTagMetricName] != int64(12) {
+		t.Fatalf("expected 12, got %v", gauges[streamTagMetricName])
+	}
+	if mt := cm.getGaugeType(gauges[streamTagMetricName]); mt != "l" {
+		t.Fatalf("expected 'l', got '%s'", mt)
+	}
+
+	t.Log("reset")
+	{
+		gauges := cm.snapGauges()
+		if _, ok := gauges[streamTagMetricName]; ok {
+			t.Fatalf("expected gauge to be reset, got %v", gauges)
+		}
+		g.Add(1)
+		gauges = cm.snapGauges()
+		if gauges[streamTagMetricName] != int64(1) {
+			t.Fatalf("expected 1, got %v", gauges[streamTagMetricName])
+		}
+	}
+
+	t.Log("no reset")
+	{
+		cm.resetGauges = false
+		g.Set(7)
+		for i := 0; i < 2; i++ {
+			gauges := cm.snapGauges()
+			if gauges[streamTagMetricName] != int64(7) {
+				t.Fatalf("expected 7, got %v", gauges[streamTagMetricName])
+			}
+		}
+	}
+
+	t.Log("remove")
+	{
+		cm.RemoveGauge(streamTagMetricName)
+		gauges := cm.snapGauges()
+		if _, ok := gauges[streamTagMetricName]; ok {
+			t.Fatalf("expected gauge to be removed, got %v", gauges)
+		}
+	}
+}
+
+func TestTypedGauges(t *testing.T) {
+	t.Log("Testing gauge.SetGauge{Int64,Uint64,Float64}")
+
+	cm := &CirconusMetrics{gauges: make(map[string]interface{})}
+
+	tags := Tags{{"foo", "bar"}}
+
+	cm.SetGaugeInt64("int", -1)
+	cm.SetGaugeUint64("uint", math.MaxUint64)
+	cm.SetGaugeFloat64("float", 1.5)
+	cm.SetGaugeFloat64WithTags("float", tags, 2.5)
+
+	tests := []struct {
+		metric string
+		value  interface{}
+		mt     string
+	}{
+		{"int", int64(-1), "l"},
+		{"uint", uint64(math.MaxUint64), "L"},
+		{"float", float64(1.5), "n"},
+		{cm.MetricNameWithStreamTags("float", tags), float64(2.5), "n"},
+	}
+
+	for _, test := range tests {
+		val, err := cm.GetGaugeTest(test.metric)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if val != test.value {
+			t.Fatalf("%s expected %v (%T), got %v (%T)", test.metric, test.value, test.value, val, val)
+		}
+		if mt := cm.getGaugeType(val); mt != test.mt {
+			t.Fatalf("%s expected type %s, got %s", test.metric, test.mt, mt)
+		}
+	}
+}
+
+func TestAddGaugeMixedTypes(t *testing.T) {
+	t.Log("Testing gauge.AddGauge with mixed types")
+
+	var buf bytes.Buffer
+
+	tests := []struct {
+		desc     string
+		initial  interface{}
+		add      func(cm *CirconusMetrics)
+		expected interface{}
+	}{
+		{"int64+int64", int64(1), func(cm *CirconusMetrics) { cm.AddGaugeInt64("foo", 2) }, int64(3)},
+		{"uint64+uint64", uint64(1), func(cm *CirconusMetrics) { cm.AddGaugeUint64("foo", 2) }, uint64(3)},
+		{"float64+float64", float64(1.5), func(cm *CirconusMetrics) { cm.AddGaugeFloat64("foo", 2) }, float64(3.5)},
+		{"int+float64", int(1), func(cm *CirconusMetrics) { cm.AddGaugeFloat64("foo", 0.5) }, float64(1.5)},
+		{"float64+int64", float64(0.5), func(cm *CirconusMetrics) { cm.AddGaugeInt64("foo", 1) }, float64(1.5)},
+		{"int+int64", int(1), func(cm *CirconusMetrics) { cm.AddGaugeInt64("foo", -2) }, int64(-1)},
+		{"uint8+uint64", uint8(1), func(cm *CirconusMetrics) { cm.AddGaugeUint64("foo", 2) }, uint64(3)},
+		{"uint64+int64", uint64(5), func(cm *CirconusMetrics) { cm.AddGaugeInt64("foo", -2) }, int64(3)},
+		{"int64+uint64", int64(-5), func(cm *CirconusMetrics) { cm.AddGaugeUint64("foo", 2) }, int64(-3)},
+		{"int64+uint64 overflow", int64(-1), func(cm *CirconusMetrics) { cm.AddGaugeUint64("foo", math.MaxUint64) }, float64(math.MaxUint64) - 1},
+		{"uint64 overflow+int64", uint64(math.MaxUint64), func(cm *CirconusMetrics) { cm.AddGaugeInt64("foo", -1) }, float64(math.MaxUint64) - 1},
+		{"float32+float64", float32(1), func(cm *CirconusMetrics) { cm.AddGaugeFloat64("foo", 1) }, float64(2)},
+		{"string+int64", "1", func(cm *CirconusMetrics) { cm.AddGaugeInt64("foo", 1) }, int64(1)},
+		{"int64+string", int64(1), func(cm *CirconusMetrics) { cm.AddGauge("foo", "1") }, int64(1)},
+		{"new", nil, func(cm *CirconusMetrics) { cm.AddGaugeFloat64WithTags("foo", Tags{}, 1) }, float64(1)},
+	}
+
+	for _, test := range tests {
+		t.Log(test.desc)
+
+		cm := &CirconusMetrics{
+			gauges: make(map[string]interface{}),
+			Log:    log.New(&buf, "", 0),
+		}
+		if test.initial != nil {
+			cm.SetGauge("foo", test.initial)
+		}
+
+		test.add(cm)
+
+		val, err := cm.GetGaugeTest("foo")
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if val != test.expected {
+			t.Fatalf("expected %v (%T), got %v (%T)", test.expected, test.expected, val, val)
+		}
+	}
+
+	if !strings.Contains(buf.String(), "unsupported type string") {
+		t.Fatalf("expected unsupported type to be logged, got %q", buf.String())
+	}
+}
+
+func TestSetGaugeFuncTyped(t *testing.T) {
+	t.Log("Testing gauge.SetGaugeFunc{Float64,Uint64}")
+
+	cm := &CirconusMetrics{}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("bar", tags)
+
+	cm.SetGaugeFuncFloat64("foo", func() float64 { return 0.5 })
+	cm.SetGaugeFuncUint64WithTags("bar", tags, func() uint64 { return math.MaxUint64 })
+	cm.SetGaugeFuncFloat64WithTags("baz", tags, func() float64 { return 1 })
+
+	gauges := cm.snapGauges()
+
+	if v, ok := gauges["foo"].(float64); !ok || v != 0.5 {
+		t.Fatalf("expected float64 0.5, got %v (%T)", gauges["foo"], gauges["foo"])
+	}
+	if mt := cm.getGaugeType(gauges["foo"]); mt != "n" {
+		t.Fatalf("expected type n, got %s", mt)
+	}
+
+	if v, ok := gauges[streamTagMetricName].(uint64); !ok || v != math.MaxUint64 {
+		t.Fatalf("expected uint64 %d, got %v (%T)", uint64(math.MaxUint64), gauges[streamTagMetricName], gauges[streamTagMetricName])
+	}
+	if mt := cm.getGaugeType(gauges[streamTagMetricName]); mt != "L" {
+		t.Fatalf("expected type L, got %s", mt)
+	}
+
+	t.Log("non-finite values are skipped")
+	{
+		cm.SetGaugeFuncFloat64("nan", func() float64 { return math.NaN() })
+		cm.SetGaugeFuncFloat64("inf", func() float64 { return math.Inf(-1) })
+		cm.gauges = map[string]interface{}{"inf32": float32(math.Inf(1))}
+		gauges := cm.snapGauges()
+		for _, name := range []string{"nan", "inf", "inf32"} {
+			if v, ok := gauges[name]; ok {
+				t.Fatalf("expected %s to be skipped, got %v", name, v)
+			}
+		}
+		if _, ok := gauges["foo"]; !ok {
+			t.Fatal("expected foo")
+		}
+		cm.RemoveGaugeFunc("nan")
+		cm.RemoveGaugeFunc("inf")
+	}
+
+	t.Log("replace function of different type")
+	{
+		cm.SetGaugeFunc("foo", func() int64 { return 2 })
+		gauges := cm.snapGauges()
+		if v, ok := gauges["foo"].(int64); !ok || v != 2 {
+			t.Fatalf("expected int64 2, got %v (%T)", gauges["foo"], gauges["foo"])
+		}
+	}
+
+	t.Log("remove")
+	{
+		cm.RemoveGaugeFunc("foo")
+		cm.RemoveGaugeFuncWithTags("bar", tags)
+		cm.RemoveGaugeFuncWithTags("baz", tags)
+		if gauges := cm.snapGauges(); len(gauges) != 0 {
+			t.Fatalf("expected no gauges, got %v", gauges)
+		}
+	}
+}
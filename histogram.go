@@ -14,9 +14,12 @@ import (
 
 // Histogram measures the distribution of a stream of values.
 type Histogram struct {
-	rw   sync.RWMutex
-	hist *circonusllhist.Histogram
-	name string
+	hist    *circonusllhist.Histogram
+	name    string
+	rw      sync.RWMutex
+	fresh   bool // created or recorded to since the last flush
+	pinned  bool // instance returned by NewHistogram, retained across resets
+	removed bool // no longer tracked, recorders must look the histogram up again
 }
 
 // TimingWithTags adds a value to a histogram metric with tags
@@ -58,16 +61,12 @@ func (m *CirconusMetrics) RecordCountForValueWithTags(metric string, tags Tags,
 
 // RecordCountForValue adds count n for value to a histogram
 func (m *CirconusMetrics) RecordCountForValue(metric string, val float64, n int64) {
-	hist := m.NewHistogram(metric)
-
-	m.hm.Lock()
-	hist.rw.Lock()
-	err := hist.hist.RecordValues(val, n)
+	err := m.recordHistogram(metric, false, func(h *circonusllhist.Histogram) error {
+		return h.RecordValues(val, n)
+	})
 	if err != nil {
 		m.Log.Printf("error recording histogram values (%v)\n", err)
 	}
-	hist.rw.Unlock()
-	m.hm.Unlock()
 }
 
 // SetHistogramValueWithTags adds a value to a histogram metric with tags
@@ -77,16 +76,12 @@ func (m *CirconusMetrics) SetHistogramValueWithTags(metric string, tags Tags, va
 
 // SetHistogramValue adds a value to a histogram
 func (m *CirconusMetrics) SetHistogramValue(metric string, val float64) {
-	hist := m.NewHistogram(metric)
-
-	m.hm.Lock()
-	hist.rw.Lock()
-	err := hist.hist.RecordValue(val)
+	err := m.recordHistogram(metric, false, func(h *circonusllhist.Histogram) error {
+		return h.RecordValue(val)
+	})
 	if err != nil {
 		m.Log.Printf("error recording histogram value (%v)\n", err)
 	}
-	hist.rw.Unlock()
-	m.hm.Unlock()
 }
 
 // SetHistogramDurationWithTags adds a value to a histogram with tags
@@ -96,16 +91,12 @@ func (m *CirconusMetrics) SetHistogramDurationWithTags(metric string, tags Tags,
 
 // SetHistogramDuration adds a value to a histogram
 func (m *CirconusMetrics) SetHistogramDuration(metric string, val time.Duration) {
-	hist := m.NewHistogram(metric)
-
-	m.hm.Lock()
-	hist.rw.Lock()
-	err := hist.hist.RecordDuration(val)
+	err := m.recordHistogram(metric, false, func(h *circonusllhist.Histogram) error {
+		return h.RecordDuration(val)
+	})
 	if err != nil {
 		m.Log.Printf("error recording histogram duration (%v)\n", err)
 	}
-	hist.rw.Unlock()
-	m.hm.Unlock()
 }
 
 // RemoveHistogramWithTags removes a histogram metric with tags
@@ -117,7 +108,40 @@ func (m *CirconusMetrics) RemoveHistogramWithTags(metric string, tags Tags) {
 func (m *CirconusMetrics) RemoveHistogram(metric string) {
 	m.hm.Lock()
 	defer m.hm.Unlock()
-	delete(m.histograms, metric)
+	if hist, ok := m.histograms[metric]; ok {
+		hist.rw.Lock()
+		hist.removed = true
+		hist.rw.Unlock()
+		delete(m.histograms, metric)
+	}
+}
+
+// SetHistogramFuncWithTags sets a histogram metric with tags to a function [called at flush interval]
+func (m *CirconusMetrics) SetHistogramFuncWithTags(metric string, tags Tags, fn func() *circonusllhist.Histogram) {
+	m.SetHistogramFunc(m.MetricNameWithStreamTags(metric, tags), fn)
+}
+
+// SetHistogramFunc sets a histogram to a function [called at flush interval].
+// The histogram returned is copied, it is not reset, a nil histogram is skipped.
+func (m *CirconusMetrics) SetHistogramFunc(metric string, fn func() *circonusllhist.Histogram) {
+	m.hfm.Lock()
+	defer m.hfm.Unlock()
+	if m.histogramFuncs == nil {
+		m.histogramFuncs = make(map[string]func() *circonusllhist.Histogram)
+	}
+	m.histogramFuncs[metric] = fn
+}
+
+// RemoveHistogramFuncWithTags removes a histogram metric with tags function
+func (m *CirconusMetrics) RemoveHistogramFuncWithTags(metric string, tags Tags) {
+	m.RemoveHistogramFunc(m.MetricNameWithStreamTags(metric, tags))
+}
+
+// RemoveHistogramFunc removes a histogram function
+func (m *CirconusMetrics) RemoveHistogramFunc(metric string) {
+	m.hfm.Lock()
+	defer m.hfm.Unlock()
+	delete(m.histogramFuncs, metric)
 }
 
 // NewHistogramWithTags returns a histogram metric with tags instance
@@ -125,29 +149,95 @@ func (m *CirconusMetrics) NewHistogramWithTags(metric string, tags Tags) *Histog
 	return m.NewHistogram(m.MetricNameWithStreamTags(metric, tags))
 }
 
-// NewHistogram returns a histogram instance.
+// NewHistogram returns a histogram instance. The instance is retained
+// when histograms are reset on flush, so it can be held and recorded to
+// for the life of the application.
 func (m *CirconusMetrics) NewHistogram(metric string) *Histogram {
+	for {
+		hist := m.histogram(metric, false)
+
+		// a flush may stop tracking an idle histogram after it was looked up
+		hist.rw.Lock()
+		if hist.removed {
+			hist.rw.Unlock()
+			continue
+		}
+		hist.pinned = true
+		hist.rw.Unlock()
+
+		return hist
+	}
+}
+
+// histogram returns the named histogram, creating it if needed. Looking up
+// an existing histogram only takes a read lock on the histogram index.
+func (m *CirconusMetrics) histogram(metric string, cumulative bool) *Histogram {
+	m.hm.RLock()
+	hist, ok := m.histogramIndex(cumulative)[metric]
+	m.hm.RUnlock()
+	if ok {
+		return hist
+	}
+
 	m.hm.Lock()
 	defer m.hm.Unlock()
 
-	if hist, ok := m.histograms[metric]; ok {
+	if hist, ok := m.histogramIndex(cumulative)[metric]; ok {
 		return hist
 	}
 
-	hist := &Histogram{
-		name: metric,
-		hist: circonusllhist.New(),
+	hist = &Histogram{
+		name:  metric,
+		hist:  circonusllhist.New(),
+		fresh: true,
 	}
 
-	m.histograms[metric] = hist
+	if cumulative {
+		if m.cumulativeHistograms == nil {
+			m.cumulativeHistograms = make(map[string]*Histogram)
+		}
+		m.cumulativeHistograms[metric] = hist
+	} else {
+		m.histograms[metric] = hist
+	}
 
 	return hist
 }
 
+// histogramIndex returns the index of cumulative or regular histograms.
+// Caller must hold the lock.
+func (m *CirconusMetrics) histogramIndex(cumulative bool) map[string]*Histogram {
+	if cumulative {
+		return m.cumulativeHistograms
+	}
+	return m.histograms
+}
+
+// recordHistogram records to the named histogram holding only the lock
+// of the histogram itself, so recording to different histograms does not
+// contend. If a flush stopped tracking the histogram after it was looked
+// up, it is looked up (re-created) again so the value is not lost.
+func (m *CirconusMetrics) recordHistogram(metric string, cumulative bool, record func(*circonusllhist.Histogram) error) error {
+	for {
+		hist := m.histogram(metric, cumulative)
+
+		hist.rw.Lock()
+		if hist.removed {
+			hist.rw.Unlock()
+			continue
+		}
+		err := record(hist.hist)
+		hist.fresh = true
+		hist.rw.Unlock()
+
+		return err
+	}
+}
+
 // GetHistogramTest returns the current value for a histogram. (note: it is a function specifically for "testing", disable automatic submission during testing.)
 func (m *CirconusMetrics) GetHistogramTest(metric string) ([]string, error) {
-	m.hm.Lock()
-	defer m.hm.Unlock()
+	m.hm.RLock()
+	defer m.hm.RUnlock()
 
 	if hist, ok := m.histograms[metric]; ok {
 		hist.rw.Lock()
@@ -170,6 +260,7 @@ func (h *Histogram) RecordValue(v float64) {
 	h.rw.Lock()
 	defer h.rw.Unlock()
 	_ = h.hist.RecordValue(v)
+	h.fresh = true
 }
 
 // RecordDuration records the given time.Duration to a histogram instance.
@@ -178,4 +269,126 @@ func (h *Histogram) RecordDuration(v time.Duration) {
 	h.rw.Lock()
 	defer h.rw.Unlock()
 	_ = h.hist.RecordDuration(v)
+	h.fresh = true
+}
+
+// Quantiles returns the approximate values at the quantiles qs, which must be
+// in ascending order and within 0..1. An error is returned if the histogram is empty.
+func (h *Histogram) Quantiles(qs []float64) ([]float64, error) {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	vals, err := h.hist.ApproxQuantile(qs)
+	if err != nil {
+		return nil, errors.Wrap(err, "computing quantiles")
+	}
+	return vals, nil
+}
+
+// Count returns the number of values recorded to a histogram instance
+func (h *Histogram) Count() uint64 {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return h.hist.Count()
+}
+
+// Mean returns the approximate mean of the values recorded to a histogram
+// instance (NaN if the histogram is empty)
+func (h *Histogram) Mean() float64 {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return h.hist.ApproxMean()
+}
+
+// Min returns the approximate minimum value recorded to a histogram
+// instance (NaN if the histogram is empty)
+func (h *Histogram) Min() float64 {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return h.hist.Min()
+}
+
+// Max returns the approximate maximum value recorded to a histogram
+// instance (NaN if the histogram is empty)
+func (h *Histogram) Max() float64 {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return h.hist.Max()
+}
+
+// ApproxSum returns the approximate sum of the values recorded to a histogram instance
+func (h *Histogram) ApproxSum() float64 {
+	h.rw.RLock()
+	defer h.rw.RUnlock()
+	return h.hist.ApproxSum()
+}
+
+// lookupHistogram returns the named histogram or cumulative histogram
+func (m *CirconusMetrics) lookupHistogram(metric string) (*Histogram, error) {
+	m.hm.RLock()
+	defer m.hm.RUnlock()
+
+	if hist, ok := m.histograms[metric]; ok {
+		return hist, nil
+	}
+	if hist, ok := m.cumulativeHistograms[metric]; ok {
+		return hist, nil
+	}
+
+	return nil, errors.Errorf("Histogram metric '%s' not found", metric)
+}
+
+// HistogramQuantiles returns the approximate values at the quantiles qs for a
+// histogram. Note, histograms are reset on flush when ResetHistograms is enabled,
+// the values reflect what has been recorded since the last flush.
+func (m *CirconusMetrics) HistogramQuantiles(metric string, qs []float64) ([]float64, error) {
+	hist, err := m.lookupHistogram(metric)
+	if err != nil {
+		return nil, err
+	}
+	return hist.Quantiles(qs)
+}
+
+// HistogramCount returns the number of values recorded to a histogram
+func (m *CirconusMetrics) HistogramCount(metric string) (uint64, error) {
+	hist, err := m.lookupHistogram(metric)
+	if err != nil {
+		return 0, err
+	}
+	return hist.Count(), nil
+}
+
+// HistogramMean returns the approximate mean of the values recorded to a histogram
+func (m *CirconusMetrics) HistogramMean(metric string) (float64, error) {
+	hist, err := m.lookupHistogram(metric)
+	if err != nil {
+		return 0, err
+	}
+	return hist.Mean(), nil
+}
+
+// HistogramMin returns the approximate minimum value recorded to a histogram
+func (m *CirconusMetrics) HistogramMin(metric string) (float64, error) {
+	hist, err := m.lookupHistogram(metric)
+	if err != nil {
+		return 0, err
+	}
+	return hist.Min(), nil
+}
+
+// HistogramMax returns the approximate maximum value recorded to a histogram
+func (m *CirconusMetrics) HistogramMax(metric string) (float64, error) {
+	hist, err := m.lookupHistogram(metric)
+	if err != nil {
+		return 0, err
+	}
+	return hist.Max(), nil
+}
+
+// HistogramApproxSum returns the approximate sum of the values recorded to a histogram
+func (m *CirconusMetrics) HistogramApproxSum(metric string) (float64, error) {
+	hist, err := m.lookupHistogram(metric)
+	if err != nil {
+		return 0, err
+	}
+	return hist.ApproxSum(), nil
 }
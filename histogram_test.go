@@ -6,9 +6,14 @@ package circonusgometrics
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/openhistogram/circonusllhist"
 )
 
 func TestTiming(t *testing.T) {
@@ -422,6 +427,40 @@ func TestNewHistogram(t *testing.T) {
 	}
 }
 
+func TestNewHistogramConcurrentFlush(t *testing.T) {
+	t.Log("Testing histogram.NewHistogram during a flush removing idle histograms")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram), resetHistograms: true}
+
+	cm.RecordValue("foo", 1)
+	idle := cm.histograms["foo"]
+
+	// hold the histogram so NewHistogram looks it up and then waits, while
+	// a flush stops tracking it (as snapHistograms does for idle histograms)
+	idle.rw.Lock()
+	result := make(chan *Histogram)
+	go func() {
+		result <- cm.NewHistogram("foo")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cm.hm.Lock()
+	idle.removed = true
+	delete(cm.histograms, "foo")
+	cm.hm.Unlock()
+	idle.rw.Unlock()
+
+	hist := <-result
+	if hist == idle {
+		t.Fatal("expected a new histogram, the idle one is no longer tracked")
+	}
+	cm.hm.RLock()
+	tracked := cm.histograms["foo"] == hist
+	cm.hm.RUnlock()
+	if !tracked || !hist.pinned {
+		t.Fatal("expected the histogram returned to be tracked and pinned")
+	}
+}
+
 func TestNewHistogramWithTags(t *testing.T) {
 	t.Log("Testing histogram.NewHistogram")
 
@@ -497,3 +536,246 @@ func TestHistRecordValue(t *testing.T) {
 		t.Fatalf("Expected non-nil")
 	}
 }
+
+func TestHistogramReset(t *testing.T) {
+	t.Log("Testing histogram reset on snapshot")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram), resetHistograms: true}
+
+	cm.SetHistogramValue("foo", 1)
+	pinned := cm.NewHistogram("bar")
+	pinned.RecordValue(1)
+
+	h := cm.snapHistograms()
+	if len(h) != 2 {
+		t.Fatalf("expected 2 histograms, got %d", len(h))
+	}
+
+	h = cm.snapHistograms()
+	if len(h) != 0 {
+		t.Fatalf("expected 0 histograms, got %d", len(h))
+	}
+	if _, ok := cm.histograms["foo"]; ok {
+		t.Fatal("expected idle histogram foo to no longer be tracked")
+	}
+	if _, ok := cm.histograms["bar"]; !ok {
+		t.Fatal("expected histogram bar instance to be retained")
+	}
+
+	pinned.RecordValue(2)
+	cm.SetHistogramValue("foo", 2)
+
+	h = cm.snapHistograms()
+	if len(h) != 2 {
+		t.Fatalf("expected 2 histograms, got %d", len(h))
+	}
+	if h["bar"].DecStrings()[0] != "H[2.0e+00]=1" {
+		t.Fatalf("expected H[2.0e+00]=1, got %v", h["bar"].DecStrings())
+	}
+}
+
+func TestHistogramConcurrentRecord(t *testing.T) {
+	t.Log("Testing concurrent histogram recording and snapshots")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram), resetHistograms: true}
+
+	const workers = 8
+	const records = 1000
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < records; j++ {
+				cm.SetHistogramValue("foo", 1)
+			}
+		}()
+	}
+
+	var total uint64
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, h := range cm.snapHistograms() {
+			total += h.Count()
+		}
+	}
+
+	if total != workers*records {
+		t.Fatalf("expected %d values, got %d", workers*records, total)
+	}
+}
+
+func BenchmarkSetHistogramValue(b *testing.B) {
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cm.SetHistogramValue("foo", float64(i%1000))
+	}
+}
+
+func BenchmarkSetHistogramValueParallel(b *testing.B) {
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+	var id uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// each goroutine records to its own histogram
+		name := fmt.Sprintf("foo%d", atomic.AddUint64(&id, 1))
+		i := 0
+		for pb.Next() {
+			cm.SetHistogramValue(name, float64(i%1000))
+			i++
+		}
+	})
+}
+
+func BenchmarkSetHistogramValueParallelShared(b *testing.B) {
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			cm.SetHistogramValue("foo", float64(i%1000))
+			i++
+		}
+	})
+}
+
+func TestSetHistogramFunc(t *testing.T) {
+	t.Log("Testing histogram.SetHistogramFunc")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram), resetHistograms: true}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("bar", tags)
+
+	pool := circonusllhist.New()
+	_ = pool.RecordValue(1)
+	_ = pool.RecordValue(2)
+
+	cm.SetHistogramFunc("foo", func() *circonusllhist.Histogram { return pool })
+	cm.SetHistogramFuncWithTags("bar", tags, func() *circonusllhist.Histogram { return nil })
+
+	for i := 0; i < 2; i++ {
+		hists := cm.snapHistograms()
+		h, ok := hists["foo"]
+		if !ok {
+			t.Fatalf("expected foo histogram, got %v", hists)
+		}
+		if h == pool {
+			t.Fatal("expected a copy of the histogram")
+		}
+		if h.Count() != 2 {
+			t.Fatalf("expected 2 samples, got %d", h.Count())
+		}
+		if _, ok := hists[streamTagMetricName]; ok {
+			t.Fatal("expected nil histogram to be skipped")
+		}
+	}
+
+	if pool.Count() != 2 {
+		t.Fatalf("expected function histogram not to be reset, got %d", pool.Count())
+	}
+
+	cm.RemoveHistogramFunc("foo")
+	cm.RemoveHistogramFuncWithTags("bar", tags)
+	if hists := cm.snapHistograms(); len(hists) != 0 {
+		t.Fatalf("expected no histograms, got %v", hists)
+	}
+}
+
+func TestHistogramStats(t *testing.T) {
+	t.Log("Testing histogram statistics")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+
+	h := cm.NewHistogram("foo")
+
+	if _, err := h.Quantiles([]float64{0.5}); err == nil {
+		t.Fatal("expected error, empty histogram")
+	}
+	if v := h.Mean(); !math.IsNaN(v) {
+		t.Fatalf("expected NaN, got %v", v)
+	}
+
+	for i := 1; i <= 100; i++ {
+		h.RecordValue(float64(i))
+	}
+	cm.SetCumulativeHistogramValue("bar", 10)
+
+	if c := h.Count(); c != 100 {
+		t.Fatalf("expected 100, got %d", c)
+	}
+
+	qs, err := h.Quantiles([]float64{0, 0.5, 0.99, 1})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	expected := []float64{1, 50, 99, 100}
+	for i, q := range qs {
+		if math.Abs(q-expected[i]) > expected[i]/10 { // within a bin
+			t.Fatalf("quantile %d expected ~%v, got %v", i, expected[i], q)
+		}
+	}
+
+	if _, err := h.Quantiles([]float64{0.9, 0.5}); err == nil {
+		t.Fatal("expected error, out of order quantiles")
+	}
+
+	if v := h.Min(); v != 1 {
+		t.Fatalf("expected 1, got %v", v)
+	}
+	if v := h.Max(); math.Abs(v-100) > 10 {
+		t.Fatalf("expected ~100, got %v", v)
+	}
+	if v := h.Mean(); math.Abs(v-50.5) > 1 {
+		t.Fatalf("expected ~50.5, got %v", v)
+	}
+	if v := h.ApproxSum(); math.Abs(v-5050) > 505 {
+		t.Fatalf("expected ~5050, got %v", v)
+	}
+
+	t.Log("CirconusMetrics")
+	{
+		if c, err := cm.HistogramCount("foo"); err != nil || c != 100 {
+			t.Fatalf("expected 100, got %d (%v)", c, err)
+		}
+		if c, err := cm.HistogramCount("bar"); err != nil || c != 1 {
+			t.Fatalf("expected 1, got %d (%v)", c, err)
+		}
+		if qs, err := cm.HistogramQuantiles("foo", []float64{0.5}); err != nil || math.Abs(qs[0]-50) > 1 {
+			t.Fatalf("expected ~50, got %v (%v)", qs, err)
+		}
+		if v, err := cm.HistogramMin("bar"); err != nil || v != 10 {
+			t.Fatalf("expected 10, got %v (%v)", v, err)
+		}
+		if v, err := cm.HistogramMax("foo"); err != nil || math.Abs(v-100) > 10 {
+			t.Fatalf("expected ~100, got %v (%v)", v, err)
+		}
+		if v, err := cm.HistogramMean("foo"); err != nil || math.Abs(v-50.5) > 1 {
+			t.Fatalf("expected ~50.5, got %v (%v)", v, err)
+		}
+		if v, err := cm.HistogramApproxSum("bar"); err != nil || math.Abs(v-10) > 1 {
+			t.Fatalf("expected ~10, got %v (%v)", v, err)
+		}
+		if _, err := cm.HistogramCount("baz"); err == nil {
+			t.Fatal("expected error")
+		}
+		if _, err := cm.HistogramQuantiles("baz", []float64{0.5}); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package httpmetrics provides net/http instrumentation for circonus-gometrics
+package httpmetrics
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultServerPrefix = "http_server"
+	defaultRoute        = "other"
+	otherMethod         = "OTHER"
+)
+
+// Options for the server middleware
+type Options struct {
+	// Prefix for metric names, default "http_server"
+	Prefix string
+
+	// RouteFunc returns the route name used to tag metrics for a request.
+	// It must return a bounded set of names (e.g. "/users/{id}" rather than
+	// the request path) to keep the number of metric streams under control.
+	// If not set, all requests are tagged with route "other".
+	RouteFunc func(*http.Request) string
+
+	// Tags identifying the handler, added to every request metric. Use
+	// distinct tags (or prefix) when instrumenting more than one handler.
+	Tags cgm.Tags
+}
+
+// Metrics recorded by the middleware (each tagged with the Options.Tags):
+//
+//   <prefix>_requests           counter, tagged method, route, status
+//   <prefix>_request_duration   histogram (seconds), tagged method, route, status
+//   <prefix>_request_size       histogram (bytes), tagged method, route
+//   <prefix>_response_size      histogram (bytes), tagged method, route, status
+//   <prefix>_in_flight          gauge, requests being handled
+//
+// Methods other than the standard HTTP methods are tagged "OTHER", status
+// is the status class (e.g. "2xx").
+
+// Middleware returns a function wrapping an http.Handler, recording
+// request metrics for each request handled.
+func Middleware(m *cgm.CirconusMetrics, opts *Options) func(http.Handler) http.Handler {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = defaultServerPrefix
+	}
+
+	var inFlight int64
+	m.SetGaugeFuncWithTags(o.Prefix+"_in_flight", o.Tags, func() int64 {
+		return atomic.LoadInt64(&inFlight)
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&inFlight, 1)
+
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w}
+			var body *countingReader
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingReader{ReadCloser: r.Body}
+				r.Body = body
+			}
+
+			defer func() {
+				atomic.AddInt64(&inFlight, -1)
+
+				p := recover()
+				if p != nil && !rw.wroteHeader {
+					rw.status = http.StatusInternalServerError
+				}
+
+				route := defaultRoute
+				if o.RouteFunc != nil {
+					if rn := o.RouteFunc(r); rn != "" {
+						route = rn
+					}
+				}
+
+				var reqSize int64
+				if body != nil {
+					reqSize = atomic.LoadInt64(&body.n)
+				}
+
+				o.record(m, r.Method, route, rw.statusCode(), reqSize, rw.size, time.Since(start))
+
+				if p != nil {
+					panic(p)
+				}
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// record emits the metrics for a request
+func (o *Options) record(m *cgm.CirconusMetrics, method, route string, status int, reqSize, respSize int64, elapsed time.Duration) {
+	tags := make(cgm.Tags, 0, len(o.Tags)+3)
+	tags = append(tags, o.Tags...)
+	tags = append(tags,
+		cgm.Tag{Category: "method", Value: normalizeMethod(method)},
+		cgm.Tag{Category: "route", Value: route},
+	)
+	m.RecordValueWithTags(o.Prefix+"_request_size", tags, float64(reqSize))
+
+	tags = append(tags, cgm.Tag{Category: "status", Value: StatusClass(status)})
+	m.IncrementWithTags(o.Prefix+"_requests", tags)
+	m.RecordDurationWithTags(o.Prefix+"_request_duration", tags, elapsed)
+	m.RecordValueWithTags(o.Prefix+"_response_size", tags, float64(respSize))
+}
+
+// StatusClass returns the class of an HTTP status code (e.g. "2xx"),
+// "unknown" for codes outside 100-599
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// normalizeMethod bounds the method tag to the standard HTTP methods
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return otherMethod
+}
+
+// responseWriter records the status code and number of bytes written
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+// WriteHeader records the first final status, informational statuses (e.g.
+// 103 Early Hints) may be followed by another status and are not recorded
+func (rw *responseWriter) WriteHeader(status int) {
+	if !rw.wroteHeader && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		rw.status = status
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher if the underlying ResponseWriter does
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		if !rw.wroteHeader {
+			rw.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// ReadFrom implements io.ReaderFrom, using the underlying ResponseWriter's
+// ReadFrom (e.g. sendfile) if it has one
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	var n int64
+	var err error
+	if rf, ok := rw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(rw.ResponseWriter, r)
+	}
+	rw.size += n
+	return n, err
+}
+
+// Unwrap returns the underlying ResponseWriter, allowing
+// http.ResponseController to reach its optional methods
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack implements http.Hijacker if the underlying ResponseWriter does
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	if !rw.wroteHeader {
+		rw.status = http.StatusSwitchingProtocols
+		rw.wroteHeader = true
+	}
+	return h.Hijack()
+}
+
+// statusCode returns the status sent, handlers which do not call
+// WriteHeader or Write respond with 200
+func (rw *responseWriter) statusCode() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+	return rw.status
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64 // atomic, handlers may read the body from another goroutine
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,267 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpmetrics
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+func TestMiddleware(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	baseTags := cgm.Tags{{Category: "service", Value: "test"}}
+	inFlightName := cm.MetricNameWithStreamTags("api_in_flight", baseTags)
+
+	var inFlight interface{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight = (*cm.FlushMetricsNoReset())[inFlightName].Value
+		_, _ = ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = io.WriteString(w, "hello")
+	})
+
+	mw := Middleware(cm, &Options{
+		Prefix: "api",
+		Tags:   baseTags,
+		RouteFunc: func(r *http.Request) string {
+			if strings.HasPrefix(r.URL.Path, "/users/") {
+				return "/users/{id}"
+			}
+			return ""
+		},
+	})(handler)
+
+	for _, path := range []string{"/users/1", "/users/2"} {
+		rec := httptest.NewRecorder()
+		mw.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader("body")))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	mw.ServeHTTP(rec, httptest.NewRequest("BREW", "/missing", nil))
+
+	if inFlight != int64(1) {
+		t.Fatalf("expected 1 request in flight, got %v", inFlight)
+	}
+
+	tags := func(method, route, status string) cgm.Tags {
+		tags := cgm.Tags{
+			{Category: "service", Value: "test"},
+			{Category: "method", Value: method},
+			{Category: "route", Value: route},
+		}
+		if status != "" {
+			tags = append(tags, cgm.Tag{Category: "status", Value: status})
+		}
+		return tags
+	}
+
+	t.Log("requests")
+	{
+		name := cm.MetricNameWithStreamTags("api_requests", tags("POST", "/users/{id}", "2xx"))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 2 {
+			t.Fatalf("expected 2, got %d (%v)", v, err)
+		}
+		name = cm.MetricNameWithStreamTags("api_requests", tags("OTHER", "other", "4xx"))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+			t.Fatalf("expected 1, got %d (%v)", v, err)
+		}
+	}
+
+	t.Log("duration")
+	{
+		name := cm.MetricNameWithStreamTags("api_request_duration", tags("POST", "/users/{id}", "2xx"))
+		if c, err := cm.HistogramCount(name); err != nil || c != 2 {
+			t.Fatalf("expected 2, got %d (%v)", c, err)
+		}
+	}
+
+	t.Log("sizes")
+	{
+		name := cm.MetricNameWithStreamTags("api_request_size", tags("POST", "/users/{id}", ""))
+		if v, err := cm.HistogramMin(name); err != nil || v != 4 {
+			t.Fatalf("expected 4, got %v (%v)", v, err)
+		}
+		name = cm.MetricNameWithStreamTags("api_response_size", tags("POST", "/users/{id}", "2xx"))
+		if v, err := cm.HistogramMin(name); err != nil || v != 5 {
+			t.Fatalf("expected 5, got %v (%v)", v, err)
+		}
+	}
+
+	t.Log("in flight after requests")
+	{
+		if v := (*cm.FlushMetricsNoReset())[inFlightName].Value; v != int64(0) {
+			t.Fatalf("expected 0, got %v", v)
+		}
+	}
+}
+
+func TestMiddlewarePanic(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	mw := Middleware(cm, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	func() {
+		defer func() {
+			if p := recover(); p != "boom" {
+				t.Fatalf("expected panic to be propagated, got %v", p)
+			}
+		}()
+		mw.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+
+	name := cm.MetricNameWithStreamTags("http_server_requests", cgm.Tags{
+		{Category: "method", Value: "GET"},
+		{Category: "route", Value: "other"},
+		{Category: "status", Value: "5xx"},
+	})
+	if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+		t.Fatalf("expected 1, got %d (%v)", v, err)
+	}
+}
+
+func TestMiddlewareInformational(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	server := httptest.NewServer(Middleware(cm, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		http.NotFound(w, r)
+	})))
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", resp.StatusCode)
+	}
+
+	// waits for the handler, and the middleware, to complete
+	server.Close()
+
+	for status, expected := range map[string]uint64{"4xx": 1, "1xx": 0} {
+		name := cm.MetricNameWithStreamTags("http_server_requests", cgm.Tags{
+			{Category: "method", Value: "GET"},
+			{Category: "route", Value: "other"},
+			{Category: "status", Value: status},
+		})
+		v, _ := cm.GetCounterTest(name)
+		if v != expected {
+			t.Fatalf("%s expected %d, got %d", status, expected, v)
+		}
+	}
+}
+
+// deadlineRecorder supports write deadlines, which the middleware's
+// ResponseWriter only exposes through Unwrap
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadline time.Time
+}
+
+func (dr *deadlineRecorder) SetWriteDeadline(deadline time.Time) error {
+	dr.deadline = deadline
+	return nil
+}
+
+func TestMiddlewareResponseController(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	deadline := time.Now().Add(time.Minute)
+	mw := Middleware(cm, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+			t.Errorf("unexpected error (%s)", err)
+		}
+		rf, ok := w.(io.ReaderFrom)
+		if !ok {
+			t.Error("expected io.ReaderFrom")
+			return
+		}
+		if _, err := rf.ReadFrom(strings.NewReader("hello world")); err != nil {
+			t.Errorf("unexpected error (%s)", err)
+		}
+	}))
+
+	rec := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	mw.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if !rec.deadline.Equal(deadline) {
+		t.Fatalf("expected write deadline %s, got %s", deadline, rec.deadline)
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello world" {
+		t.Fatalf("expected 200 'hello world', got %d %q", rec.Code, rec.Body.String())
+	}
+
+	tags := cgm.Tags{
+		{Category: "method", Value: "GET"},
+		{Category: "route", Value: "other"},
+		{Category: "status", Value: "2xx"},
+	}
+	if v, err := cm.HistogramMin(cm.MetricNameWithStreamTags("http_server_response_size", tags)); err != nil || v != 11 {
+		t.Fatalf("expected 11, got %v (%v)", v, err)
+	}
+}
+
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{
+		0:   "unknown",
+		101: "1xx",
+		200: "2xx",
+		302: "3xx",
+		404: "4xx",
+		503: "5xx",
+		600: "unknown",
+	}
+	for status, expected := range tests {
+		if class := StatusClass(status); class != expected {
+			t.Fatalf("%d expected %s, got %s", status, expected, class)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpmetrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultClientPrefix = "http_client"
+
+	errorClassDNS      = "dns"
+	errorClassDial     = "dial"
+	errorClassTLS      = "tls"
+	errorClassTimeout  = "timeout"
+	errorClassCanceled = "canceled"
+	errorClassOther    = "other"
+)
+
+// TransportOptions for the instrumented client transport
+type TransportOptions struct {
+	// Prefix for metric names, default "http_client"
+	Prefix string
+
+	// Tags identifying the client, added alongside the host and status tags
+	Tags cgm.Tags
+}
+
+// Metrics recorded by the transport (each tagged with the TransportOptions.Tags):
+//
+//   <prefix>_request_duration   histogram (seconds, until response headers), tagged host, status
+//   <prefix>_errors             counter, tagged host, error (dns, dial, tls, timeout, canceled, other)
+//   <prefix>_connections        counter, tagged host, reused (true, false)
+
+// Transport is an http.RoundTripper recording metrics for outbound requests
+type Transport struct {
+	next   http.RoundTripper
+	m      *cgm.CirconusMetrics
+	prefix string
+	tags   cgm.Tags
+}
+
+// NewTransport returns an instrumented http.RoundTripper wrapping next
+// (http.DefaultTransport if nil).
+func NewTransport(m *cgm.CirconusMetrics, next http.RoundTripper, opts *TransportOptions) *Transport {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	t := &Transport{
+		next:   next,
+		m:      m,
+		prefix: defaultClientPrefix,
+	}
+	if opts != nil {
+		if opts.Prefix != "" {
+			t.prefix = opts.Prefix
+		}
+		t.tags = opts.Tags
+	}
+
+	return t
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	tr := &requestTrace{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.m.IncrementWithTags(t.prefix+"_connections", t.withTags(
+				cgm.Tag{Category: "host", Value: host},
+				cgm.Tag{Category: "reused", Value: strconv.FormatBool(info.Reused)},
+			))
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				tr.fail(errorClassDNS)
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			tr.connectDone(err)
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				tr.fail(errorClassTLS)
+			}
+		},
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	elapsed := time.Since(start)
+
+	if err != nil {
+		t.m.IncrementWithTags(t.prefix+"_errors", t.withTags(
+			cgm.Tag{Category: "host", Value: host},
+			cgm.Tag{Category: "error", Value: classifyError(err, tr.failure())},
+		))
+		return resp, err
+	}
+
+	t.m.RecordDurationWithTags(t.prefix+"_request_duration", t.withTags(
+		cgm.Tag{Category: "host", Value: host},
+		cgm.Tag{Category: "status", Value: StatusClass(resp.StatusCode)},
+	), elapsed)
+
+	return resp, nil
+}
+
+// CloseIdleConnections closes idle connections of the wrapped transport
+func (t *Transport) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if ci, ok := t.next.(closeIdler); ok {
+		ci.CloseIdleConnections()
+	}
+}
+
+// withTags returns the transport tags with the additional tags
+func (t *Transport) withTags(tags ...cgm.Tag) cgm.Tags {
+	all := make(cgm.Tags, 0, len(t.tags)+len(tags))
+	all = append(all, t.tags...)
+	return append(all, tags...)
+}
+
+// requestTrace records the last connection phase which failed
+type requestTrace struct {
+	class     string
+	connected bool
+	mu        sync.Mutex
+}
+
+func (tr *requestTrace) fail(class string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.class = class
+}
+
+// connectDone records the result of a dial attempt, a failed attempt does
+// not count once another attempt (e.g. Happy Eyeballs fallback) connected
+func (tr *requestTrace) connectDone(err error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if err == nil {
+		tr.connected = true
+		if tr.class == errorClassDial {
+			tr.class = ""
+		}
+		return
+	}
+	if !tr.connected {
+		tr.class = errorClassDial
+	}
+}
+
+func (tr *requestTrace) failure() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.class
+}
+
+// classifyError returns the error class for a failed request, traced is
+// the class of the connection phase which failed (if any)
+func classifyError(err error, traced string) string {
+	if errors.Is(err, context.Canceled) {
+		return errorClassCanceled
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return errorClassDNS
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorClassTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errorClassTimeout
+	}
+
+	if traced != "" {
+		return traced
+	}
+
+	var recordErr tls.RecordHeaderError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certInvalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &unknownAuthErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &certInvalidErr) {
+		return errorClassTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return errorClassDial
+	}
+
+	return errorClassOther
+}
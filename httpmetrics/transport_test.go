@@ -0,0 +1,228 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httpmetrics
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
+	"testing"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+func TestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+
+	host := server.Listener.Addr().String()
+
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	baseTags := cgm.Tags{{Category: "service", Value: "test"}}
+	transport := NewTransport(cm, &http.Transport{}, &TransportOptions{Tags: baseTags})
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport}
+
+	tags := func(tags ...cgm.Tag) cgm.Tags {
+		return append(cgm.Tags{{Category: "service", Value: "test"}}, tags...)
+	}
+
+	for _, path := range []string{"/", "/", "/missing"} {
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		_, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+
+	t.Log("duration")
+	{
+		name := cm.MetricNameWithStreamTags("http_client_request_duration", tags(cgm.Tag{Category: "host", Value: host}, cgm.Tag{Category: "status", Value: "2xx"}))
+		if c, err := cm.HistogramCount(name); err != nil || c != 2 {
+			t.Fatalf("expected 2, got %d (%v)", c, err)
+		}
+		name = cm.MetricNameWithStreamTags("http_client_request_duration", tags(cgm.Tag{Category: "host", Value: host}, cgm.Tag{Category: "status", Value: "4xx"}))
+		if c, err := cm.HistogramCount(name); err != nil || c != 1 {
+			t.Fatalf("expected 1, got %d (%v)", c, err)
+		}
+	}
+
+	t.Log("connections")
+	{
+		name := cm.MetricNameWithStreamTags("http_client_connections", tags(cgm.Tag{Category: "host", Value: host}, cgm.Tag{Category: "reused", Value: "false"}))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+			t.Fatalf("expected 1, got %d (%v)", v, err)
+		}
+		name = cm.MetricNameWithStreamTags("http_client_connections", tags(cgm.Tag{Category: "host", Value: host}, cgm.Tag{Category: "reused", Value: "true"}))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 2 {
+			t.Fatalf("expected 2, got %d (%v)", v, err)
+		}
+	}
+
+	t.Log("timeout")
+	{
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		req, err := http.NewRequest("GET", server.URL+"/slow", nil)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if _, err := client.Do(req.WithContext(ctx)); err == nil {
+			t.Fatal("expected error")
+		}
+		name := cm.MetricNameWithStreamTags("http_client_errors", tags(cgm.Tag{Category: "host", Value: host}, cgm.Tag{Category: "error", Value: "timeout"}))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+			t.Fatalf("expected 1, got %d (%v)", v, err)
+		}
+	}
+
+	t.Log("dial")
+	{
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		closedHost := l.Addr().String()
+		l.Close()
+
+		if _, err := client.Get("http://" + closedHost + "/"); err == nil {
+			t.Fatal("expected error")
+		}
+		name := cm.MetricNameWithStreamTags("http_client_errors", tags(cgm.Tag{Category: "host", Value: closedHost}, cgm.Tag{Category: "error", Value: "dial"}))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+			t.Fatalf("expected 1, got %d (%v)", v, err)
+		}
+	}
+
+	t.Log("tls")
+	{
+		tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		tlsServer.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+		tlsServer.StartTLS()
+		defer tlsServer.Close()
+
+		// server certificate is not trusted by the client
+		if _, err := client.Get(tlsServer.URL); err == nil {
+			t.Fatal("expected error")
+		}
+		name := cm.MetricNameWithStreamTags("http_client_errors", tags(cgm.Tag{Category: "host", Value: tlsServer.Listener.Addr().String()}, cgm.Tag{Category: "error", Value: "tls"}))
+		if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+			t.Fatalf("expected 1, got %d (%v)", v, err)
+		}
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestTransportTracedPhase(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	dialErr := errors.New("connection refused")
+	tlsErr := errors.New("x509: certificate signed by unknown authority")
+
+	tests := []struct {
+		host     string
+		phases   func(trace *httptrace.ClientTrace)
+		expected string
+	}{
+		{"fallback-tls", func(trace *httptrace.ClientTrace) {
+			trace.ConnectDone("tcp", "[::1]:443", dialErr)
+			trace.ConnectDone("tcp", "127.0.0.1:443", nil)
+			trace.TLSHandshakeDone(tls.ConnectionState{}, tlsErr)
+		}, "tls"},
+		{"late-dial", func(trace *httptrace.ClientTrace) {
+			trace.ConnectDone("tcp", "127.0.0.1:443", nil)
+			trace.ConnectDone("tcp", "[::1]:443", dialErr)
+			trace.TLSHandshakeDone(tls.ConnectionState{}, tlsErr)
+		}, "tls"},
+		{"dial", func(trace *httptrace.ClientTrace) {
+			trace.ConnectDone("tcp", "[::1]:443", dialErr)
+			trace.ConnectDone("tcp", "127.0.0.1:443", dialErr)
+		}, "dial"},
+	}
+
+	for _, test := range tests {
+		phases := test.phases
+		transport := NewTransport(cm, roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			phases(httptrace.ContextClientTrace(req.Context()))
+			return nil, errors.New("request failed")
+		}), nil)
+
+		req, err := http.NewRequest("GET", "https://"+test.host+"/", nil)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if _, err := transport.RoundTrip(req); err == nil {
+			t.Fatal("expected error")
+		}
+		name := cm.MetricNameWithStreamTags("http_client_errors", cgm.Tags{{Category: "host", Value: test.host}, {Category: "error", Value: test.expected}})
+		if v, err := cm.GetCounterTest(name); err != nil || v != 1 {
+			t.Fatalf("%s expected 1, got %d (%v)", test.host, v, err)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err      error
+		traced   string
+		expected string
+	}{
+		{&url.Error{Op: "Get", URL: "http://foo.invalid", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "foo.invalid"}}}, "", "dns"},
+		{&url.Error{Op: "Get", URL: "http://foo", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}, "", "dial"},
+		{&url.Error{Op: "Get", URL: "http://foo", Err: timeoutError{}}, "", "timeout"},
+		{fmt.Errorf("wrapped: %w", context.DeadlineExceeded), "", "timeout"},
+		{context.Canceled, "", "canceled"},
+		{errors.New("remote error: tls: bad certificate"), "tls", "tls"},
+		{errors.New("unexpected EOF"), "", "other"},
+	}
+
+	for _, test := range tests {
+		if class := classifyError(test.err, test.traced); class != test.expected {
+			t.Fatalf("%v expected %s, got %s", test.err, test.expected, class)
+		}
+	}
+}
@@ -7,7 +7,9 @@ package circonusgometrics
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"math"
 	"strings"
 	"sync"
 	"time"
@@ -38,10 +40,13 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 		m.Log.Printf("setting custom timestamp %v -> %v (UTC ms)", *m.submitTimestamp, ts)
 	}
 
+	m.runCollectors()
+
 	newMetrics := make(map[string]*apiclient.CheckBundleMetric)
 	counters, gauges, histograms, text := m.snapshot()
+	cumulativeHistograms := m.snapCumulativeHistograms()
 	m.custm.Lock()
-	output := make(Metrics, len(counters)+len(gauges)+len(histograms)+len(text)+len(m.custom))
+	output := make(Metrics, len(counters)+len(gauges)+len(histograms)+len(cumulativeHistograms)+len(text)+len(m.custom))
 	if len(m.custom) > 0 {
 		// add and reset any custom metrics
 		for mn, mv := range m.custom {
@@ -50,8 +55,9 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 		m.custom = make(map[string]Metric)
 	}
 	m.custm.Unlock()
+	counterNames := make(map[string]bool, len(counters))
 	for name, value := range counters {
-		send := m.check.IsMetricActive(name)
+		send := m.check == nil || m.check.IsMetricActive(name)
 		if !send && m.check.ActivateMetric(name) {
 			send = true
 			newMetrics[name] = &apiclient.CheckBundleMetric{
@@ -66,11 +72,12 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 				metric.Timestamp = ts
 			}
 			output[name] = metric
+			counterNames[name] = true
 		}
 	}
 
 	for name, value := range gauges {
-		send := m.check.IsMetricActive(name)
+		send := m.check == nil || m.check.IsMetricActive(name)
 		if !send && m.check.ActivateMetric(name) {
 			send = true
 			newMetrics[name] = &apiclient.CheckBundleMetric{
@@ -89,7 +96,7 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 	}
 
 	for name, value := range histograms {
-		send := m.check.IsMetricActive(name)
+		send := m.check == nil || m.check.IsMetricActive(name)
 		if !send && m.check.ActivateMetric(name) {
 			send = true
 			newMetrics[name] = &apiclient.CheckBundleMetric{
@@ -114,8 +121,32 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 		}
 	}
 
+	for name, value := range cumulativeHistograms {
+		send := m.check == nil || m.check.IsMetricActive(name)
+		if !send && m.check.ActivateMetric(name) {
+			send = true
+			newMetrics[name] = &apiclient.CheckBundleMetric{
+				Name:   name,
+				Type:   "histogram",
+				Status: "active",
+			}
+		}
+		if send {
+			buf := bytes.NewBuffer([]byte{})
+			if err := value.SerializeB64(buf); err != nil {
+				m.Log.Printf("[ERR] serializing cumulative histogram %s: %s", name, err)
+			} else {
+				metric := Metric{Type: MetricTypeCumulativeHistogram, Value: buf.String()}
+				if ts > 0 {
+					metric.Timestamp = ts
+				}
+				output[name] = metric
+			}
+		}
+	}
+
 	for name, value := range text {
-		send := m.check.IsMetricActive(name)
+		send := m.check == nil || m.check.IsMetricActive(name)
 		if !send && m.check.ActivateMetric(name) {
 			send = true
 			newMetrics[name] = &apiclient.CheckBundleMetric{
@@ -136,6 +167,9 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 	m.lastMetrics.metricsmu.Lock()
 	defer m.lastMetrics.metricsmu.Unlock()
 	m.lastMetrics.metrics = &output
+	m.lastMetrics.counters = counterNames
+	m.lastMetrics.resetCounters = m.resetCounters
+	m.lastMetrics.resetHistograms = m.resetHistograms
 	m.lastMetrics.ts = time.Now()
 	// reset the submission timestamp
 	m.submitTimestamp = nil
@@ -143,7 +177,10 @@ func (m *CirconusMetrics) packageMetrics() (map[string]*apiclient.CheckBundleMet
 	return newMetrics, output
 }
 
-// PromOutput returns lines of metrics in prom format
+// PromOutput returns lines of metrics in prom format.
+//
+// Deprecated: histograms, text and stream tags are not supported, use
+// PrometheusHandler.
 func (m *CirconusMetrics) PromOutput() (*bytes.Buffer, error) {
 	m.lastMetrics.metricsmu.Lock()
 	defer m.lastMetrics.metricsmu.Unlock()
@@ -181,15 +218,10 @@ func (m *CirconusMetrics) PromOutput() (*bytes.Buffer, error) {
 
 // FlushMetricsNoReset flushes current metrics to a structure and returns it (does NOT send to Circonus).
 func (m *CirconusMetrics) FlushMetricsNoReset() *Metrics {
-	m.flushmu.Lock()
-	if m.flushing {
-		m.flushmu.Unlock()
+	if !m.startFlush() {
 		return &Metrics{}
 	}
 
-	m.flushing = true
-	m.flushmu.Unlock()
-
 	// save values configured at startup
 	resetC := m.resetCounters
 	resetG := m.resetGauges
@@ -209,62 +241,77 @@ func (m *CirconusMetrics) FlushMetricsNoReset() *Metrics {
 	m.resetHistograms = resetH
 	m.resetText = resetT
 
-	m.flushmu.Lock()
-	m.flushing = false
-	m.flushmu.Unlock()
+	m.endFlush()
 
 	return &output
 }
 
 // FlushMetrics flushes current metrics to a structure and returns it (does NOT send to Circonus)
 func (m *CirconusMetrics) FlushMetrics() *Metrics {
-	m.flushmu.Lock()
-	if m.flushing {
-		m.flushmu.Unlock()
+	if !m.startFlush() {
 		return &Metrics{}
 	}
 
-	m.flushing = true
-	m.flushmu.Unlock()
-
 	_, output := m.packageMetrics()
 
-	m.flushmu.Lock()
-	m.flushing = false
-	m.flushmu.Unlock()
+	m.endFlush()
 
 	return &output
 }
 
 // Flush metrics kicks off the process of sending metrics to Circonus
 func (m *CirconusMetrics) Flush() {
+	_, _ = m.FlushContext(context.Background())
+}
+
+// FlushContext sends metrics to Circonus, returning the result of the submission.
+// An error is returned if the metrics could not be submitted (e.g. check not ready,
+// broker unavailable, context canceled) or if a flush is already in progress.
+func (m *CirconusMetrics) FlushContext(ctx context.Context) (*SubmitResult, error) {
+	if !m.startFlush() {
+		return nil, errors.New("flush already in progress")
+	}
+
+	result, err := m.flush(ctx)
+
+	m.endFlush()
+
+	return result, err
+}
+
+// startFlush claims the flushing flag, returning false if a flush is already in progress
+func (m *CirconusMetrics) startFlush() bool {
 	m.flushmu.Lock()
+	defer m.flushmu.Unlock()
 	if m.flushing {
-		m.flushmu.Unlock()
-		return
+		return false
 	}
-
 	m.flushing = true
-	m.flushmu.Unlock()
+	m.flushDone = make(chan struct{})
+	return true
+}
 
+// endFlush clears the flushing flag and wakes anything waiting for the flush to complete
+func (m *CirconusMetrics) endFlush() {
+	m.flushmu.Lock()
+	defer m.flushmu.Unlock()
+	m.flushing = false
+	close(m.flushDone)
+}
+
+// flush packages and submits metrics, caller must hold the flushing flag
+func (m *CirconusMetrics) flush(ctx context.Context) (*SubmitResult, error) {
 	newMetrics, output := m.packageMetrics()
 
-	if len(output) > 0 {
-		m.submit(output, newMetrics)
-	} /* else if m.Debug {
-		m.Log.Printf("no metrics to send, skipping\n")
-	}*/
+	if len(output) == 0 {
+		return &SubmitResult{}, nil
+	}
 
-	m.flushmu.Lock()
-	m.flushing = false
-	m.flushmu.Unlock()
+	return m.submit(ctx, output, newMetrics)
 }
 
 // Reset removes all existing counters and gauges.
 func (m *CirconusMetrics) Reset() {
-	m.cm.Lock()
-	defer m.cm.Unlock()
-
 	m.cfm.Lock()
 	defer m.cfm.Unlock()
 
@@ -277,18 +324,42 @@ func (m *CirconusMetrics) Reset() {
 	m.hm.Lock()
 	defer m.hm.Unlock()
 
+	m.hfm.Lock()
+	defer m.hfm.Unlock()
+
+	m.colm.Lock()
+	defer m.colm.Unlock()
+
 	m.tm.Lock()
 	defer m.tm.Unlock()
 
 	m.tfm.Lock()
 	defer m.tfm.Unlock()
 
-	m.counters = make(map[string]uint64)
+	for _, hist := range m.histograms {
+		hist.rw.Lock()
+		hist.removed = true
+		hist.rw.Unlock()
+	}
+	for _, hist := range m.cumulativeHistograms {
+		hist.rw.Lock()
+		hist.removed = true
+		hist.rw.Unlock()
+	}
+
+	m.counters.reset()
 	m.counterFuncs = make(map[string]func() uint64)
 	m.gauges = make(map[string]interface{})
+	m.gaugeHandles = make(map[string]*Gauge)
 	m.gaugeFuncs = make(map[string]func() int64)
+	m.gaugeFloat64Funcs = make(map[string]func() float64)
+	m.gaugeUint64Funcs = make(map[string]func() uint64)
 	m.histograms = make(map[string]*Histogram)
+	m.cumulativeHistograms = make(map[string]*Histogram)
+	m.histogramFuncs = make(map[string]func() *circonusllhist.Histogram)
+	m.collectors = make(map[string]*registeredCollector)
 	m.text = make(map[string]string)
+	m.textHandles = make(map[string]*Text)
 	m.textFuncs = make(map[string]func() string)
 }
 
@@ -336,23 +407,16 @@ func (m *CirconusMetrics) snapshot() (
 }
 
 func (m *CirconusMetrics) snapCounters() map[string]uint64 {
-	m.cm.Lock()
 	m.cfm.Lock()
 
-	c := make(map[string]uint64, len(m.counters)+len(m.counterFuncs))
+	c := make(map[string]uint64, len(m.counterFuncs))
 
-	for n, v := range m.counters {
-		c[n] = v
-	}
-	if m.resetCounters && len(c) > 0 {
-		m.counters = make(map[string]uint64)
-	}
+	m.counters.snap(c, m.resetCounters)
 
 	for n, f := range m.counterFuncs {
 		c[n] = f()
 	}
 
-	m.cm.Unlock()
 	m.cfm.Unlock()
 
 	return c
@@ -362,45 +426,108 @@ func (m *CirconusMetrics) snapGauges() map[string]interface{} {
 	m.gm.Lock()
 	m.gfm.Lock()
 
-	g := make(map[string]interface{}, len(m.gauges)+len(m.gaugeFuncs))
+	g := make(map[string]interface{}, len(m.gauges)+len(m.gaugeFuncs)+len(m.gaugeFloat64Funcs)+len(m.gaugeUint64Funcs))
 
 	for n, v := range m.gauges {
-		g[n] = v
+		m.snapGauge(g, n, v)
 	}
-	if m.resetGauges && len(g) > 0 {
+	if m.resetGauges && len(m.gauges) > 0 {
 		m.gauges = make(map[string]interface{})
 	}
 
+	for n, gh := range m.gaugeHandles {
+		if v, ok := gh.snap(m.resetGauges); ok {
+			g[n] = v
+		}
+	}
+
 	for n, f := range m.gaugeFuncs {
 		g[n] = f()
 	}
 
+	for n, f := range m.gaugeFloat64Funcs {
+		m.snapGauge(g, n, f())
+	}
+
+	for n, f := range m.gaugeUint64Funcs {
+		g[n] = f()
+	}
+
 	m.gm.Unlock()
 	m.gfm.Unlock()
 
 	return g
 }
 
+// snapGauge adds a gauge value to a snapshot, skipping non-finite (NaN, ±Inf)
+// float values which cannot be encoded in the submission payload
+func (m *CirconusMetrics) snapGauge(g map[string]interface{}, name string, v interface{}) {
+	var f float64
+	switch tv := v.(type) {
+	case float64:
+		f = tv
+	case float32:
+		f = float64(tv)
+	default:
+		g[name] = v
+		return
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		if m.Debug {
+			m.Log.Printf("[DEBUG] skipping gauge %s, non-finite value %v", name, f)
+		}
+		return
+	}
+	g[name] = v
+}
+
 func (m *CirconusMetrics) snapHistograms() map[string]*circonusllhist.Histogram {
 	m.hm.Lock()
+	m.hfm.Lock()
 
-	h := make(map[string]*circonusllhist.Histogram, len(m.histograms))
+	h := make(map[string]*circonusllhist.Histogram, len(m.histograms)+len(m.histogramFuncs))
 
 	for n, hist := range m.histograms {
 		hist.rw.Lock()
-		if m.resetHistograms {
-			h[n] = hist.hist.CopyAndReset()
-		} else {
+		switch {
+		case !m.resetHistograms:
 			h[n] = hist.hist.Copy()
+		case hist.fresh:
+			h[n] = hist.hist.CopyAndReset()
+			hist.fresh = false
+		case !hist.pinned:
+			// nothing recorded since the last flush, stop tracking it
+			hist.removed = true
+			delete(m.histograms, n)
 		}
 		hist.rw.Unlock()
 	}
 
-	if m.resetHistograms && len(h) > 0 {
-		m.histograms = make(map[string]*Histogram)
+	for n, f := range m.histogramFuncs {
+		if hist := f(); hist != nil {
+			h[n] = hist.Copy()
+		}
 	}
 
 	m.hm.Unlock()
+	m.hfm.Unlock()
+
+	return h
+}
+
+// snapCumulativeHistograms returns copies of the cumulative histograms,
+// they are never reset
+func (m *CirconusMetrics) snapCumulativeHistograms() map[string]*circonusllhist.Histogram {
+	m.hm.RLock()
+	defer m.hm.RUnlock()
+
+	h := make(map[string]*circonusllhist.Histogram, len(m.cumulativeHistograms))
+
+	for n, hist := range m.cumulativeHistograms {
+		hist.rw.Lock()
+		h[n] = hist.hist.Copy()
+		hist.rw.Unlock()
+	}
 
 	return h
 }
@@ -418,6 +545,12 @@ func (m *CirconusMetrics) snapText() map[string]string {
 		m.text = make(map[string]string)
 	}
 
+	for n, th := range m.textHandles {
+		if v, ok := th.snap(m.resetText); ok {
+			t[n] = v
+		}
+	}
+
 	for n, f := range m.textFuncs {
 		t[n] = f()
 	}
@@ -5,6 +5,8 @@
 package circonusgometrics
 
 import (
+	"context"
+	"net/http"
 	"strings"
 	"testing"
 )
@@ -101,6 +103,88 @@ func TestFlush(t *testing.T) {
 	}
 }
 
+func TestFlushContext(t *testing.T) {
+	server := fakeBroker()
+	defer server.Close()
+
+	t.Log("Already flushing")
+	{
+		cfg := &Config{Interval: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.flushing = true
+		if _, err := cm.FlushContext(context.Background()); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+
+	t.Log("No metrics")
+	{
+		cfg := &Config{Interval: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		result, err := cm.FlushContext(context.Background())
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if result.Stats != 0 || result.Attempts != 0 {
+			t.Fatalf("Expected empty result, got %#v", result)
+		}
+	}
+
+	t.Log("counter")
+	{
+		cfg := &Config{Interval: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.Set("foo", 30)
+
+		result, err := cm.FlushContext(context.Background())
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+		if result.Stats != 1 {
+			t.Fatalf("Expected 1 stat, got %#v", result)
+		}
+		if result.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %#v", result)
+		}
+		if result.PayloadBytes == 0 {
+			t.Fatalf("Expected payload bytes, got %#v", result)
+		}
+	}
+
+	t.Log("canceled context")
+	{
+		cfg := &Config{Interval: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("Expected no error, got '%v'", err)
+		}
+
+		cm.Set("foo", 30)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := cm.FlushContext(ctx); err == nil {
+			t.Fatal("Expected error")
+		}
+	}
+}
+
 func TestFlushMetricsNoReset(t *testing.T) {
 	cfg := &Config{}
 	cfg.CheckManager.Check.SubmissionURL = "none"
@@ -642,7 +726,6 @@ func TestReset(t *testing.T) {
 
 	cm := &CirconusMetrics{}
 
-	cm.counters = make(map[string]uint64)
 	cm.counterFuncs = make(map[string]func() uint64)
 	cm.Increment("foo")
 
@@ -658,8 +741,8 @@ func TestReset(t *testing.T) {
 	cm.textFuncs = make(map[string]func() string)
 	cm.SetText("foo", "bar")
 
-	if len(cm.counters) != 1 {
-		t.Errorf("Expected 1, found %d", len(cm.counters))
+	if cm.counters.len() != 1 {
+		t.Errorf("Expected 1, found %d", cm.counters.len())
 	}
 
 	if len(cm.gauges) != 1 {
@@ -676,8 +759,8 @@ func TestReset(t *testing.T) {
 
 	cm.Reset()
 
-	if len(cm.counters) != 0 {
-		t.Errorf("Expected 0, found %d", len(cm.counters))
+	if cm.counters.len() != 0 {
+		t.Errorf("Expected 0, found %d", cm.counters.len())
 	}
 
 	if len(cm.gauges) != 0 {
@@ -699,7 +782,6 @@ func TestSnapshot(t *testing.T) {
 	cm := &CirconusMetrics{}
 
 	cm.resetCounters = true
-	cm.counters = make(map[string]uint64)
 	cm.counterFuncs = make(map[string]func() uint64)
 	cm.Increment("foo")
 
@@ -718,8 +800,8 @@ func TestSnapshot(t *testing.T) {
 	cm.textFuncs = make(map[string]func() string)
 	cm.SetText("foo", "bar")
 
-	if len(cm.counters) != 1 {
-		t.Errorf("Expected 1, found %d", len(cm.counters))
+	if cm.counters.len() != 1 {
+		t.Errorf("Expected 1, found %d", cm.counters.len())
 	}
 
 	if len(cm.gauges) != 1 {
@@ -0,0 +1,305 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package procmetrics publishes Linux process metrics, read from /proc/self,
+// to circonus-gometrics.
+package procmetrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultPrefix   = "process"
+	defaultProcPath = "/proc"
+
+	// userHZ is the unit of the cpu times in /proc/self/stat, it is 100
+	// on all supported architectures (sysconf(_SC_CLK_TCK) needs cgo)
+	userHZ = 100
+)
+
+// Options for the process metrics collector
+type Options struct {
+	// Prefix for metric names, default "process". The prefix also names
+	// the collector.
+	Prefix string
+
+	// ProcPath is the mount point of procfs, default "/proc"
+	ProcPath string
+
+	// Tags identifying the process, e.g. app:api
+	Tags cgm.Tags
+}
+
+// Metrics published (each tagged with the Options.Tags):
+//
+//   <prefix>_cpu_user_seconds                 gauge, cpu time in user mode
+//   <prefix>_cpu_system_seconds               gauge, cpu time in kernel mode
+//   <prefix>_cpu_seconds                      gauge, total cpu time
+//   <prefix>_resident_memory_bytes            gauge
+//   <prefix>_virtual_memory_bytes             gauge
+//   <prefix>_open_fds                         gauge
+//   <prefix>_max_fds                          gauge, soft limit
+//   <prefix>_threads                          gauge
+//   <prefix>_voluntary_context_switches       counter
+//   <prefix>_nonvoluntary_context_switches    counter
+//   <prefix>_io_read_bytes                    counter, bytes read from storage
+//   <prefix>_io_write_bytes                   counter, bytes written to storage
+//   <prefix>_io_read_chars                    counter, bytes read by syscalls
+//   <prefix>_io_write_chars                   counter, bytes written by syscalls
+//
+// The io metrics are only published if /proc/self/io is readable.
+
+// sample holds the process statistics read from procfs
+type sample struct {
+	utime            uint64 // clock ticks
+	stime            uint64 // clock ticks
+	rss              uint64 // bytes
+	vms              uint64 // bytes
+	threads          uint64
+	voluntaryCtxt    uint64
+	nonvoluntaryCtxt uint64
+	openFDs          uint64
+	maxFDs           uint64
+	readBytes        uint64
+	writeBytes       uint64
+	readChars        uint64
+	writeChars       uint64
+}
+
+// collector reads the process statistics from procfs at each flush
+type collector struct {
+	prefix string
+	dir    string
+	tags   cgm.Tags
+}
+
+// read reads the process statistics into s, except the optional io statistics
+func (c *collector) read(s *sample) error {
+	if err := readStat(filepath.Join(c.dir, "stat"), s); err != nil {
+		return err
+	}
+	if err := readStatus(filepath.Join(c.dir, "status"), s); err != nil {
+		return err
+	}
+	return readFDs(c.dir, s)
+}
+
+// Register registers a collector publishing the process metrics at each
+// flush, an error is returned if procfs cannot be read.
+func Register(m *cgm.CirconusMetrics, opts *Options) error {
+	o := options(opts)
+	c := &collector{
+		prefix: o.Prefix + "_",
+		dir:    filepath.Join(o.ProcPath, "self"),
+		tags:   o.Tags,
+	}
+
+	if err := c.read(&sample{}); err != nil {
+		return err
+	}
+
+	m.RegisterCollector(o.Prefix, c, 0)
+
+	return nil
+}
+
+// Unregister stops publishing the process metrics registered with the same Prefix.
+func Unregister(m *cgm.CirconusMetrics, opts *Options) {
+	o := options(opts)
+	m.UnregisterCollector(o.Prefix)
+}
+
+// Collect implements cgm.Collector
+func (c *collector) Collect(ctx context.Context, e *cgm.Emitter) error {
+	var s sample
+	if err := c.read(&s); err != nil {
+		return err
+	}
+
+	p := c.prefix
+	e.SetGauge(p+"cpu_user_seconds", c.tags, float64(s.utime)/userHZ)
+	e.SetGauge(p+"cpu_system_seconds", c.tags, float64(s.stime)/userHZ)
+	e.SetGauge(p+"cpu_seconds", c.tags, float64(s.utime+s.stime)/userHZ)
+	e.SetGauge(p+"resident_memory_bytes", c.tags, s.rss)
+	e.SetGauge(p+"virtual_memory_bytes", c.tags, s.vms)
+	e.SetGauge(p+"open_fds", c.tags, s.openFDs)
+	e.SetGauge(p+"max_fds", c.tags, s.maxFDs)
+	e.SetGauge(p+"threads", c.tags, s.threads)
+	e.Set(p+"voluntary_context_switches", c.tags, s.voluntaryCtxt)
+	e.Set(p+"nonvoluntary_context_switches", c.tags, s.nonvoluntaryCtxt)
+
+	if err := readIO(filepath.Join(c.dir, "io"), &s); err == nil {
+		e.Set(p+"io_read_bytes", c.tags, s.readBytes)
+		e.Set(p+"io_write_bytes", c.tags, s.writeBytes)
+		e.Set(p+"io_read_chars", c.tags, s.readChars)
+		e.Set(p+"io_write_chars", c.tags, s.writeChars)
+	}
+
+	return nil
+}
+
+func options(opts *Options) Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = defaultPrefix
+	}
+	if o.ProcPath == "" {
+		o.ProcPath = defaultProcPath
+	}
+	return o
+}
+
+// readStat reads the cpu times from /proc/self/stat
+func readStat(file string, s *sample) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "reading stat")
+	}
+
+	// the command name (2nd field) is in parens and may contain spaces
+	end := bytes.LastIndexByte(data, ')')
+	if end == -1 {
+		return errors.Errorf("parsing stat: invalid format")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	// fields[0] is the 3rd field (state), utime and stime are the 14th and 15th
+	if len(fields) < 13 {
+		return errors.Errorf("parsing stat: expected at least 15 fields, found %d", len(fields)+2)
+	}
+
+	if s.utime, err = strconv.ParseUint(fields[11], 10, 64); err != nil {
+		return errors.Wrap(err, "parsing stat utime")
+	}
+	if s.stime, err = strconv.ParseUint(fields[12], 10, 64); err != nil {
+		return errors.Wrap(err, "parsing stat stime")
+	}
+
+	return nil
+}
+
+// readStatus reads memory, thread and context switch statistics from /proc/self/status
+func readStatus(file string, s *sample) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "reading status")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var dest *uint64
+		scale := uint64(1)
+		switch parts[0] {
+		case "VmRSS":
+			dest, scale = &s.rss, 1024
+		case "VmSize":
+			dest, scale = &s.vms, 1024
+		case "Threads":
+			dest = &s.threads
+		case "voluntary_ctxt_switches":
+			dest = &s.voluntaryCtxt
+		case "nonvoluntary_ctxt_switches":
+			dest = &s.nonvoluntaryCtxt
+		default:
+			continue
+		}
+
+		v, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(parts[1]), " kB"), 10, 64)
+		if err != nil {
+			return errors.Wrapf(err, "parsing status %s", parts[0])
+		}
+		*dest = v * scale
+	}
+
+	return errors.Wrap(scanner.Err(), "reading status")
+}
+
+// readFDs counts the open file descriptors in /proc/self/fd and reads
+// the limit from /proc/self/limits
+func readFDs(dir string, s *sample) error {
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return errors.Wrap(err, "reading fd")
+	}
+	s.openFDs = uint64(len(entries))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "limits"))
+	if err != nil {
+		return errors.Wrap(err, "reading limits")
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Max open files") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Max open files"))
+		if len(fields) < 1 {
+			return errors.New("parsing limits: invalid format")
+		}
+		if fields[0] == "unlimited" {
+			s.maxFDs = 0
+			return nil
+		}
+		if s.maxFDs, err = strconv.ParseUint(fields[0], 10, 64); err != nil {
+			return errors.Wrap(err, "parsing limits max open files")
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// readIO reads the io statistics from /proc/self/io (only readable by the
+// owner of the process, it may not be available)
+func readIO(file string, s *sample) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.Wrap(err, "reading io")
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		var dest *uint64
+		switch parts[0] {
+		case "read_bytes":
+			dest = &s.readBytes
+		case "write_bytes":
+			dest = &s.writeBytes
+		case "rchar":
+			dest = &s.readChars
+		case "wchar":
+			dest = &s.writeChars
+		default:
+			continue
+		}
+
+		if *dest, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64); err != nil {
+			return errors.Wrapf(err, "parsing io %s", parts[0])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package procmetrics
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+func TestRegister(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	opts := &Options{
+		ProcPath: filepath.Join("testdata", "proc"),
+		Tags:     cgm.Tags{{Category: "app", Value: "test"}},
+	}
+
+	if err := Register(cm, opts); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output := *cm.FlushMetrics()
+
+	expected := map[string]interface{}{
+		"process_cpu_user_seconds":              float64(2.5),
+		"process_cpu_system_seconds":            float64(1.3),
+		"process_cpu_seconds":                   float64(3.8),
+		"process_resident_memory_bytes":         uint64(20000 * 1024),
+		"process_virtual_memory_bytes":          uint64(1048576 * 1024),
+		"process_open_fds":                      uint64(5),
+		"process_max_fds":                       uint64(1024),
+		"process_threads":                       uint64(12),
+		"process_voluntary_context_switches":    uint64(1500),
+		"process_nonvoluntary_context_switches": uint64(25),
+		"process_io_read_bytes":                 uint64(4096),
+		"process_io_write_bytes":                uint64(8192),
+		"process_io_read_chars":                 uint64(10240),
+		"process_io_write_chars":                uint64(2048),
+	}
+
+	// plus the collector duration
+	if len(output) != len(expected)+1 {
+		t.Fatalf("expected %d metrics, got %d (%v)", len(expected)+1, len(output), output)
+	}
+
+	for name, value := range expected {
+		metric, ok := output[cm.MetricNameWithStreamTags(name, opts.Tags)]
+		if !ok {
+			t.Fatalf("expected %s", name)
+		}
+		if metric.Value != value {
+			t.Fatalf("%s expected %v (%T), got %v (%T)", name, value, value, metric.Value, metric.Value)
+		}
+	}
+
+	if output[cm.MetricNameWithStreamTags("process_voluntary_context_switches", opts.Tags)].Type != cgm.MetricTypeUint64 {
+		t.Fatal("expected context switches to be a counter")
+	}
+
+	Unregister(cm, opts)
+
+	if output := *cm.FlushMetrics(); len(output) != 0 {
+		t.Fatalf("expected no metrics, got %v", output)
+	}
+}
+
+func TestRegisterInvalid(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if err := Register(cm, &Options{ProcPath: filepath.Join("testdata", "missing")}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRegisterLive(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("procfs is only available on linux")
+	}
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("procfs not mounted")
+	}
+
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if err := Register(cm, nil); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output := *cm.FlushMetrics()
+	if v, ok := output["process_threads"].Value.(uint64); !ok || v == 0 {
+		t.Fatalf("expected threads, got %v", output["process_threads"])
+	}
+	if v, ok := output["process_open_fds"].Value.(uint64); !ok || v == 0 {
+		t.Fatalf("expected open fds, got %v", output["process_open_fds"])
+	}
+}
@@ -0,0 +1,515 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/openhistogram/circonusllhist"
+	"github.com/pkg/errors"
+)
+
+const (
+	promContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+	promCounter   = "counter"
+	promGauge     = "gauge"
+	promSummary   = "summary"
+	promHistogram = "histogram"
+	promText      = "text" // gauge in the prometheus format, info in openmetrics
+)
+
+var defaultPromQuantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// PrometheusOptions for the Prometheus exposition handler
+type PrometheusOptions struct {
+	// Quantiles reported for histograms exposed as summaries,
+	// default 0.5, 0.9, 0.95 and 0.99
+	Quantiles []float64
+}
+
+// PrometheusHandler returns an http.Handler exposing the most recently
+// flushed metrics in the Prometheus text format, or the OpenMetrics format
+// if requested by the Accept header of the scrape.
+//
+// Stream tags are exposed as labels and metric names are sanitized, metrics
+// whose exposed names collide with a metric earlier in name order (e.g. foo.bar
+// and foo_bar, a counter and gauge of the same name, or a gauge named like the
+// _count of a histogram) are logged and not exposed. Counters
+// are exposed as counters if ResetCounters is false, otherwise the value of a
+// counter is the count for the last interval and it is exposed as a gauge.
+// Likewise histograms are exposed as Prometheus histograms if they are
+// cumulative or ResetHistograms is false, otherwise as summaries of the last
+// interval. Text metrics are exposed with the text in a "value" label.
+func (m *CirconusMetrics) PrometheusHandler(opts *PrometheusOptions) http.Handler {
+	quantiles := defaultPromQuantiles
+	if opts != nil && len(opts.Quantiles) > 0 {
+		quantiles = opts.Quantiles
+	}
+	return &promHandler{m: m, quantiles: quantiles}
+}
+
+type promHandler struct {
+	m         *CirconusMetrics
+	quantiles []float64
+}
+
+func (h *promHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+
+	h.m.lastMetrics.metricsmu.Lock()
+	metrics := h.m.lastMetrics.metrics
+	counters := h.m.lastMetrics.counters
+	resetCounters := h.m.lastMetrics.resetCounters
+	resetHistograms := h.m.lastMetrics.resetHistograms
+	h.m.lastMetrics.metricsmu.Unlock()
+
+	var b bytes.Buffer
+	bw := bufio.NewWriter(&b)
+	if metrics != nil {
+		for _, f := range h.m.promFamilies(*metrics, counters, resetCounters, resetHistograms) {
+			f.write(bw, openMetrics, h.quantiles)
+		}
+	}
+	if openMetrics {
+		bw.WriteString("# EOF\n")
+	}
+	if err := bw.Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if openMetrics {
+		w.Header().Set("Content-Type", openMetricsContentType)
+	} else {
+		w.Header().Set("Content-Type", promContentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	_, _ = w.Write(b.Bytes())
+}
+
+// promFamily is a set of samples sharing a (sanitized) metric name
+type promFamily struct {
+	name    string
+	base    string // metric name before sanitizing
+	kind    string
+	samples []promSample
+}
+
+type promSample struct {
+	hist   *circonusllhist.Histogram
+	value  string
+	labels []promLabel
+}
+
+type promLabel struct {
+	name  string
+	value string
+}
+
+// promFamilies groups metrics into families sorted by name, dropping metrics
+// and families which collide with those before them. The reset settings are
+// those used when the metrics were packaged.
+func (m *CirconusMetrics) promFamilies(metrics Metrics, counters map[string]bool, resetCounters, resetHistograms bool) []*promFamily {
+	families := make(map[string]*promFamily)
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		metric := metrics[name]
+		s := promSample{}
+		var kind string
+
+		switch metric.Type {
+		case MetricTypeHistogram, MetricTypeCumulativeHistogram:
+			hist, err := decodeHistogram(metric.Value)
+			if err != nil {
+				m.Log.Printf("[WARN] exposing histogram %s: %s", name, err)
+				continue
+			}
+			s.hist = hist
+			kind = promSummary
+			if metric.Type == MetricTypeCumulativeHistogram || !resetHistograms {
+				kind = promHistogram
+			}
+		case MetricTypeString:
+			v, ok := metric.Value.(string)
+			if !ok {
+				continue
+			}
+			s.value = v
+			kind = promText
+		default:
+			v, ok := promValue(metric.Value)
+			if !ok {
+				continue // e.g. custom histogram strings
+			}
+			s.value = v
+			kind = promGauge
+			if counters[name] && !resetCounters {
+				kind = promCounter
+			}
+		}
+
+		base, labels := parseStreamTags(name)
+		s.labels = labels
+		fname := promMetricName(base)
+
+		f, ok := families[fname]
+		if !ok {
+			f = &promFamily{name: fname, base: base, kind: kind}
+			families[fname] = f
+		}
+		if f.base != base || f.kind != kind {
+			m.Log.Printf("[WARN] exposing %s: %s conflicts with %s %s (%s)", name, kind, f.kind, f.base, fname)
+			continue
+		}
+		f.samples = append(f.samples, s)
+	}
+
+	list := make([]*promFamily, 0, len(families))
+	for _, f := range families {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	// e.g. a gauge named requests and a counter named requests_total are
+	// both exposed as requests in the openmetrics format
+	exposed := make(map[string]string, len(list))
+	result := list[:0]
+	for _, f := range list {
+		names := f.exposedNames()
+		conflict := ""
+		for _, n := range names {
+			if other, ok := exposed[n]; ok {
+				conflict = other
+				break
+			}
+		}
+		if conflict != "" {
+			m.Log.Printf("[WARN] exposing %s: %s conflicts with %s", f.base, f.kind, conflict)
+			continue
+		}
+		for _, n := range names {
+			exposed[n] = f.name
+		}
+		sort.Slice(f.samples, func(i, j int) bool {
+			return promLabelString(f.samples[i].labels) < promLabelString(f.samples[j].labels)
+		})
+		result = append(result, f)
+	}
+
+	return result
+}
+
+// exposedNames returns the family and sample names of the family in both
+// the prometheus and openmetrics formats
+func (f *promFamily) exposedNames() []string {
+	names := []string{f.name}
+	switch f.kind {
+	case promCounter:
+		om := strings.TrimSuffix(f.name, "_total")
+		names = append(names, om, om+"_total")
+	case promText:
+		om := strings.TrimSuffix(f.name, "_info")
+		names = append(names, om, om+"_info")
+	case promSummary:
+		names = append(names, f.name+"_sum", f.name+"_count")
+	case promHistogram:
+		names = append(names, f.name+"_bucket", f.name+"_sum", f.name+"_count")
+	}
+	return names
+}
+
+// write writes the family in the prometheus or openmetrics text format
+func (f *promFamily) write(w *bufio.Writer, openMetrics bool, quantiles []float64) {
+	name := f.name
+	kind := f.kind
+	suffix := ""
+
+	switch kind {
+	case promCounter:
+		if openMetrics {
+			name = strings.TrimSuffix(name, "_total")
+			suffix = "_total"
+		}
+	case promText:
+		kind = promGauge
+		if openMetrics {
+			name = strings.TrimSuffix(name, "_info")
+			kind = "info"
+			suffix = "_info"
+		}
+	}
+
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+
+	for _, s := range f.samples {
+		switch f.kind {
+		case promText:
+			writePromSample(w, name+suffix, s.labels, &promLabel{"value", s.value}, "1")
+		case promSummary:
+			qvs, err := s.hist.ApproxQuantile(quantiles)
+			for i, q := range quantiles {
+				v := math.NaN()
+				if err == nil && s.hist.Count() > 0 {
+					v = qvs[i]
+				}
+				writePromSample(w, name, s.labels, &promLabel{"quantile", formatPromFloat(q)}, formatPromFloat(v))
+			}
+			writePromSample(w, name+"_sum", s.labels, nil, formatPromFloat(s.hist.ApproxSum()))
+			writePromSample(w, name+"_count", s.labels, nil, strconv.FormatUint(s.hist.Count(), 10))
+		case promHistogram:
+			bounds, counts := promBuckets(s.hist)
+			for i, le := range bounds {
+				writePromSample(w, name+"_bucket", s.labels, &promLabel{"le", le}, strconv.FormatUint(counts[i], 10))
+			}
+			writePromSample(w, name+"_bucket", s.labels, &promLabel{"le", "+Inf"}, strconv.FormatUint(s.hist.Count(), 10))
+			writePromSample(w, name+"_sum", s.labels, nil, formatPromFloat(s.hist.ApproxSum()))
+			writePromSample(w, name+"_count", s.labels, nil, strconv.FormatUint(s.hist.Count(), 10))
+		default:
+			writePromSample(w, name+suffix, s.labels, nil, s.value)
+		}
+	}
+}
+
+func writePromSample(w *bufio.Writer, name string, labels []promLabel, extra *promLabel, value string) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != nil {
+		all := labels
+		if extra != nil {
+			all = append(append(make([]promLabel, 0, len(labels)+1), labels...), *extra)
+		}
+		w.WriteString(promLabelString(all))
+	}
+	w.WriteString(" " + value + "\n")
+}
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promLabelString returns the labels formatted as {name="value",...}
+func promLabelString(labels []promLabel) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(l.name + `="` + promLabelEscaper.Replace(l.value) + `"`)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// parseStreamTags splits a metric name into the base name and labels
+// decoded from its stream tags, e.g. foo|ST[b"YXBw":b"d2Vi"] -> foo {app="web"}
+func parseStreamTags(name string) (string, []promLabel) {
+	idx := strings.Index(name, "|ST[")
+	if idx == -1 || !strings.HasSuffix(name, "]") {
+		return name, nil
+	}
+
+	base := name[:idx]
+	tags := strings.Split(name[idx+4:len(name)-1], ",")
+	labels := make([]promLabel, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		ln := promLabelName(decodeStreamTag(parts[0]))
+		if ln == "" || seen[ln] {
+			continue // prometheus does not allow repeated label names
+		}
+		seen[ln] = true
+		labels = append(labels, promLabel{name: ln, value: decodeStreamTag(parts[1])})
+	}
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+	return base, labels
+}
+
+// decodeStreamTag decodes a base64 encoded (b"...") tag category or value
+func decodeStreamTag(s string) string {
+	if !strings.HasPrefix(s, `b"`) || !strings.HasSuffix(s, `"`) || len(s) < 3 {
+		return s
+	}
+	d, err := base64.StdEncoding.DecodeString(s[2 : len(s)-1])
+	if err != nil {
+		return s
+	}
+	return string(d)
+}
+
+// promMetricName sanitizes a metric name, [a-zA-Z_:][a-zA-Z0-9_:]*
+func promMetricName(name string) string {
+	return sanitizePromName(name, true)
+}
+
+// promLabelName sanitizes a label name, [a-zA-Z_][a-zA-Z0-9_]*. Names
+// reserved by prometheus, or used for quantiles, buckets and text values,
+// are prefixed with "tag_".
+func promLabelName(name string) string {
+	ln := sanitizePromName(name, false)
+	switch {
+	case ln == "":
+		return ""
+	case ln == "le" || ln == "quantile" || ln == "value" || strings.HasPrefix(ln, "__"):
+		return "tag_" + ln
+	}
+	return ln
+}
+
+func sanitizePromName(name string, colons bool) string {
+	if name == "" {
+		return ""
+	}
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		case c == ':' && colons:
+		default:
+			b[i] = '_'
+		}
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// promValue formats a numeric metric value
+func promValue(v interface{}) (string, bool) {
+	switch tv := v.(type) {
+	case int:
+		return strconv.FormatInt(int64(tv), 10), true
+	case int8:
+		return strconv.FormatInt(int64(tv), 10), true
+	case int16:
+		return strconv.FormatInt(int64(tv), 10), true
+	case int32:
+		return strconv.FormatInt(int64(tv), 10), true
+	case int64:
+		return strconv.FormatInt(tv, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(tv), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(tv), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(tv), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(tv), 10), true
+	case uint64:
+		return strconv.FormatUint(tv, 10), true
+	case float32:
+		return formatPromFloat(float64(tv)), true
+	case float64:
+		return formatPromFloat(tv), true
+	}
+	return "", false
+}
+
+func formatPromFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// decodeHistogram decodes a base64 serialized histogram metric value
+func decodeHistogram(v interface{}) (*circonusllhist.Histogram, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.Errorf("invalid histogram value (%T)", v)
+	}
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding histogram")
+	}
+	hist, err := circonusllhist.Deserialize(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "deserializing histogram")
+	}
+	return hist, nil
+}
+
+// promBuckets returns the upper bound of each histogram bin, in ascending
+// order, and the cumulative count of values up to the bound. Bins are
+// H[<mantissa>e<exponent>]=<count>, the bin of a positive value v covers
+// [v, v+10^exponent/10), of a negative value (v-10^exponent/10, v].
+func promBuckets(h *circonusllhist.Histogram) ([]string, []uint64) {
+	type bucket struct {
+		upper float64
+		count uint64
+	}
+
+	bins := h.DecStrings()
+	buckets := make([]bucket, 0, len(bins))
+	for _, bin := range bins {
+		idx := strings.Index(bin, "]=")
+		if !strings.HasPrefix(bin, "H[") || idx == -1 {
+			continue
+		}
+		count, err := strconv.ParseUint(bin[idx+2:], 10, 64)
+		if err != nil || count == 0 {
+			continue
+		}
+		val := bin[2:idx]
+		e := strings.IndexByte(val, 'e')
+		if e == -1 {
+			continue
+		}
+		mantissa, err := strconv.ParseFloat(val[:e], 64)
+		if err != nil {
+			continue
+		}
+		exp, err := strconv.Atoi(val[e+1:])
+		if err != nil {
+			continue
+		}
+		upper := mantissa * math.Pow10(exp)
+		if mantissa > 0 {
+			upper = (math.Round(mantissa*10) + 1) / 10 * math.Pow10(exp)
+		}
+		buckets = append(buckets, bucket{upper: upper, count: count})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].upper < buckets[j].upper })
+
+	bounds := make([]string, len(buckets))
+	counts := make([]uint64, len(buckets))
+	var total uint64
+	for i, b := range buckets {
+		total += b.count
+		// bins have two significant digits, three removes float noise
+		bounds[i] = strconv.FormatFloat(b.upper, 'g', 3, 64)
+		counts[i] = total
+	}
+	return bounds, counts
+}
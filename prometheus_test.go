@@ -0,0 +1,308 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/openhistogram/circonusllhist"
+)
+
+func scrape(t *testing.T, h http.Handler, accept string) (string, string) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	return rec.Header().Get("Content-Type"), rec.Body.String()
+}
+
+func expectLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+
+	have := make(map[string]bool)
+	for _, l := range strings.Split(body, "\n") {
+		have[l] = true
+	}
+	for _, l := range lines {
+		if !have[l] {
+			t.Fatalf("expected line %q in\n%s", l, body)
+		}
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	t.Log("Testing prometheus.PrometheusHandler")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	h := cm.PrometheusHandler(nil)
+
+	t.Log("no metrics")
+	{
+		ct, body := scrape(t, h, "")
+		if ct != promContentType {
+			t.Fatalf("expected %s, got %s", promContentType, ct)
+		}
+		if body != "" {
+			t.Fatalf("expected empty body, got %q", body)
+		}
+
+		_, body = scrape(t, h, "application/openmetrics-text; version=1.0.0")
+		if body != "# EOF\n" {
+			t.Fatalf("expected EOF, got %q", body)
+		}
+	}
+
+	tags := Tags{{"method", "GET"}, {"le", "x"}, {"app", "a\"b"}}
+	cm.IncrementByValueWithTags("http.requests", tags, 3)
+	cm.SetGauge("temp", 1.5)
+	cm.SetText("version", "1.2.3")
+	cm.RecordValue("latency", 1.25)
+	cm.RecordValue("latency", 2)
+	cm.SetCumulativeHistogramValue("size", 5)
+	cm.SetCumulativeHistogramValue("size", 15)
+	cm.FlushMetrics()
+
+	t.Log("prometheus format")
+	{
+		_, body := scrape(t, h, "")
+		expectLines(t, body,
+			"# TYPE http_requests gauge",
+			`http_requests{app="a\"b",method="GET",tag_le="x"} 3`,
+			"# TYPE temp gauge",
+			"temp 1.5",
+			"# TYPE version gauge",
+			`version{value="1.2.3"} 1`,
+			"# TYPE latency summary",
+			"latency_count 2",
+			"# TYPE size histogram",
+			`size_bucket{le="5.1"} 1`,
+			`size_bucket{le="16"} 2`,
+			`size_bucket{le="+Inf"} 2`,
+			"size_count 2",
+		)
+		if strings.Contains(body, "|ST[") {
+			t.Fatalf("expected stream tags to be decoded\n%s", body)
+		}
+		if !strings.Contains(body, `latency{quantile="0.5"} `) {
+			t.Fatalf("expected quantiles\n%s", body)
+		}
+	}
+
+	t.Log("openmetrics format")
+	{
+		ct, body := scrape(t, h, "application/openmetrics-text; version=1.0.0")
+		if ct != openMetricsContentType {
+			t.Fatalf("expected %s, got %s", openMetricsContentType, ct)
+		}
+		expectLines(t, body,
+			"# TYPE version info",
+			`version_info{value="1.2.3"} 1`,
+			"# TYPE size histogram",
+		)
+		if !strings.HasSuffix(body, "\n# EOF\n") {
+			t.Fatalf("expected EOF\n%s", body)
+		}
+	}
+}
+
+func TestPrometheusHandlerNoReset(t *testing.T) {
+	t.Log("Testing prometheus.PrometheusHandler counters and histograms without reset")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cfg.ResetCounters = "false"
+	cfg.ResetHistograms = "false"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cm.Increment("requests_total")
+	cm.Set("9lives", 9)
+	cm.RecordValue("latency", 0.5)
+	cm.FlushMetrics()
+
+	h := cm.PrometheusHandler(nil)
+
+	_, body := scrape(t, h, "")
+	expectLines(t, body,
+		"# TYPE requests_total counter",
+		"requests_total 1",
+		"# TYPE _9lives counter",
+		"_9lives 9",
+		"# TYPE latency histogram",
+		`latency_bucket{le="0.51"} 1`,
+		"latency_count 1",
+	)
+
+	_, body = scrape(t, h, "application/openmetrics-text")
+	expectLines(t, body,
+		"# TYPE requests counter",
+		"requests_total 1",
+	)
+}
+
+func TestPrometheusHandlerConflicts(t *testing.T) {
+	t.Log("Testing prometheus.PrometheusHandler metric name collisions")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cfg.ResetCounters = "false"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+	var buf bytes.Buffer
+	cm.Log = log.New(&buf, "", 0)
+
+	cm.SetGauge("foo.bar", 1)
+	cm.SetGauge("foo_bar", 2) // sanitized name collides with foo.bar
+	cm.IncrementWithTags("hits", Tags{{"a", "b"}})
+	cm.SetGaugeWithTags("hits", Tags{{"a", "c"}}, 5) // gauge in the hits counter family
+	cm.RecordValue("latency", 1)
+	cm.SetGauge("latency_count", 3) // collides with the latency summary
+	cm.SetGauge("requests", 4)
+	cm.Increment("requests_total") // requests in openmetrics
+	cm.FlushMetrics()
+
+	h := cm.PrometheusHandler(nil)
+
+	_, body := scrape(t, h, "")
+	expectLines(t, body,
+		"# TYPE foo_bar gauge",
+		"foo_bar 1",
+		"# TYPE hits counter",
+		`hits{a="b"} 1`,
+		"# TYPE latency summary",
+		"latency_count 1",
+		"# TYPE requests gauge",
+		"requests 4",
+	)
+	for _, s := range []string{"foo_bar 2", `hits{a="c"}`, "latency_count 3", "requests_total"} {
+		if strings.Contains(body, s) {
+			t.Fatalf("expected %s not to be exposed\n%s", s, body)
+		}
+	}
+	if n := strings.Count(buf.String(), "conflicts with"); n != 4 {
+		t.Fatalf("expected 4 conflicts to be logged, got %d\n%s", n, buf.String())
+	}
+
+	_, body = scrape(t, h, "application/openmetrics-text")
+	if n := strings.Count(body, "# TYPE requests "); n != 1 {
+		t.Fatalf("expected a single requests family, got %d\n%s", n, body)
+	}
+}
+
+func TestPrometheusHandlerConcurrentFlush(t *testing.T) {
+	t.Log("Testing prometheus.PrometheusHandler during FlushMetricsNoReset")
+
+	cfg := &Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("Expected no error, got '%v'", err)
+	}
+
+	cm.Increment("requests")
+	cm.FlushMetrics()
+
+	h := cm.PrometheusHandler(nil)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			cm.Increment("requests")
+			cm.FlushMetricsNoReset()
+		}
+	}()
+
+	// packaged by FlushMetricsNoReset the counter is exposed as a counter,
+	// otherwise as a gauge, never a mix of the two
+	for i := 0; i < 100; i++ {
+		_, body := scrape(t, h, "")
+		if !strings.Contains(body, "# TYPE requests counter") && !strings.Contains(body, "# TYPE requests gauge") {
+			t.Fatalf("expected requests\n%s", body)
+		}
+	}
+	wg.Wait()
+
+	_, body := scrape(t, h, "")
+	expectLines(t, body, "# TYPE requests counter")
+}
+
+func TestParseStreamTags(t *testing.T) {
+	t.Log("Testing prometheus.parseStreamTags")
+
+	cm := &CirconusMetrics{}
+	name := cm.MetricNameWithStreamTags("foo", Tags{{"b-cat", "v1"}, {"a", "v,2:3"}})
+
+	base, labels := parseStreamTags(name)
+	if base != "foo" {
+		t.Fatalf("expected foo, got %s", base)
+	}
+	expected := `{a="v,2:3",b_cat="v1"}`
+	if s := promLabelString(labels); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+
+	base, labels = parseStreamTags(`bar|ST[env:prod,__name__:x]`)
+	if base != "bar" {
+		t.Fatalf("expected bar, got %s", base)
+	}
+	expected = `{env="prod",tag___name__="x"}`
+	if s := promLabelString(labels); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+}
+
+func TestPromBuckets(t *testing.T) {
+	t.Log("Testing prometheus.promBuckets")
+
+	h := circonusllhist.New()
+	for _, v := range []float64{-2, 0, 0.013, 1000, 1000} {
+		_ = h.RecordValue(v)
+	}
+
+	bounds, counts := promBuckets(h)
+	expectedBounds := []string{"-2", "0", "0.014", "1.1e+03"}
+	expectedCounts := []uint64{1, 2, 3, 5}
+	if len(bounds) != len(expectedBounds) {
+		t.Fatalf("expected %v, got %v", expectedBounds, bounds)
+	}
+	for i := range bounds {
+		if bounds[i] != expectedBounds[i] || counts[i] != expectedCounts[i] {
+			t.Fatalf("expected %v %v, got %v %v", expectedBounds, expectedCounts, bounds, counts)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package runtimemetrics publishes Go runtime metrics (runtime/metrics) to
+// circonus-gometrics. It requires Go 1.16 or later.
+//
+// Cumulative integer values are published as counters, distributions (e.g.
+// /gc/pauses:seconds, /sched/latencies:seconds) as histograms and all other
+// values as gauges. Counters are integers, so cumulative float values (e.g.
+// /cpu/classes/gc/total:cpu-seconds) are published as gauges. Metric names
+// are derived from the runtime metric name, e.g. /gc/heap/allocs:bytes is
+// published as go_gc_heap_allocs_bytes.
+package runtimemetrics
@@ -0,0 +1,192 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.16
+// +build go1.16
+
+package runtimemetrics
+
+import (
+	"context"
+	"math"
+	"runtime/metrics"
+	"strings"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/openhistogram/circonusllhist"
+)
+
+const defaultPrefix = "go"
+
+// Options for the runtime metrics collector
+type Options struct {
+	// Prefix for metric names, default "go". The prefix also names the
+	// collector.
+	Prefix string
+
+	// Filter returns whether to publish the runtime metric (e.g.
+	// "/gc/pauses:seconds"), if not set all supported metrics are published
+	Filter func(name string) bool
+
+	// Tags identifying the process (e.g. app:api), added to every runtime metric
+	Tags cgm.Tags
+}
+
+// collector reads all of the runtime metrics with a single metrics.Read
+// at each flush
+type collector struct {
+	tags    cgm.Tags
+	samples []metrics.Sample
+	metrics []metric // indexed as samples
+}
+
+// metric describes how a runtime metric is published
+type metric struct {
+	name       string
+	cumulative bool
+	delta      *histogramDelta // distributions only
+}
+
+// Register registers a collector publishing the runtime metrics at each flush.
+//
+// Runtime distributions are cumulative, each flush publishes the samples
+// recorded since the previous flush.
+func Register(m *cgm.CirconusMetrics, opts *Options) {
+	o := options(opts)
+
+	descs := descriptions(o)
+	c := &collector{
+		tags:    o.Tags,
+		samples: make([]metrics.Sample, len(descs)),
+		metrics: make([]metric, len(descs)),
+	}
+	for i, desc := range descs {
+		c.samples[i].Name = desc.Name
+		c.metrics[i] = metric{
+			name:       metricName(o.Prefix, desc.Name),
+			cumulative: desc.Cumulative,
+		}
+		if desc.Kind == metrics.KindFloat64Histogram {
+			c.metrics[i].delta = &histogramDelta{}
+		}
+	}
+
+	m.RegisterCollector(o.Prefix, c, 0)
+}
+
+// Unregister stops publishing the runtime metrics registered with the same Prefix.
+func Unregister(m *cgm.CirconusMetrics, opts *Options) {
+	o := options(opts)
+	m.UnregisterCollector(o.Prefix)
+}
+
+func options(opts *Options) Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Prefix == "" {
+		o.Prefix = defaultPrefix
+	}
+	return o
+}
+
+// descriptions returns the supported runtime metrics passing the filter
+func descriptions(o Options) []metrics.Description {
+	all := metrics.All()
+	descs := make([]metrics.Description, 0, len(all))
+	for _, desc := range all {
+		if desc.Kind == metrics.KindBad {
+			continue
+		}
+		if o.Filter != nil && !o.Filter(desc.Name) {
+			continue
+		}
+		descs = append(descs, desc)
+	}
+	return descs
+}
+
+// Collect implements cgm.Collector. Collectors are not run concurrently,
+// the samples are reused on each run.
+func (c *collector) Collect(ctx context.Context, e *cgm.Emitter) error {
+	metrics.Read(c.samples)
+
+	for i, s := range c.samples {
+		mt := c.metrics[i]
+		switch s.Value.Kind() {
+		case metrics.KindUint64:
+			if mt.cumulative {
+				e.Set(mt.name, c.tags, s.Value.Uint64())
+			} else {
+				e.SetGauge(mt.name, c.tags, s.Value.Uint64())
+			}
+		case metrics.KindFloat64:
+			e.SetGauge(mt.name, c.tags, s.Value.Float64())
+		case metrics.KindFloat64Histogram:
+			e.MergeHistogram(mt.name, c.tags, mt.delta.next(s.Value.Float64Histogram()))
+		}
+	}
+
+	return nil
+}
+
+// metricName converts a runtime metric name to a metric name,
+// e.g. /gc/heap/allocs:bytes -> <prefix>_gc_heap_allocs_bytes
+func metricName(prefix, name string) string {
+	return prefix + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// histogramDelta converts a cumulative runtime distribution to a histogram
+// of the samples recorded since the previous call
+type histogramDelta struct {
+	prev []uint64
+}
+
+// next returns a histogram of the samples recorded since the previous call
+// (nil if there are none)
+func (d *histogramDelta) next(h *metrics.Float64Histogram) *circonusllhist.Histogram {
+	if h == nil {
+		return nil
+	}
+
+	if len(d.prev) != len(h.Counts) {
+		d.prev = make([]uint64, len(h.Counts))
+	}
+
+	var hist *circonusllhist.Histogram
+	for i, count := range h.Counts {
+		n := count
+		if count >= d.prev[i] {
+			n -= d.prev[i]
+		}
+		d.prev[i] = count
+		if n == 0 {
+			continue
+		}
+		if hist == nil {
+			hist = circonusllhist.New()
+		}
+		_ = hist.RecordValues(bucketValue(h.Buckets[i], h.Buckets[i+1]), int64(n))
+	}
+
+	return hist
+}
+
+// bucketValue returns the value representing a runtime distribution bucket,
+// the midpoint or, for buckets without a lower or upper bound, the bound
+func bucketValue(lower, upper float64) float64 {
+	switch {
+	case math.IsInf(lower, -1):
+		return upper
+	case math.IsInf(upper, 1):
+		return lower
+	}
+	return lower + (upper-lower)/2
+}
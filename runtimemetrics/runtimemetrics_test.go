@@ -0,0 +1,121 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.16
+// +build go1.16
+
+package runtimemetrics
+
+import (
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+func TestRegister(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	include := map[string]bool{
+		"/gc/cycles/total:gc-cycles":     true,
+		"/sched/goroutines:goroutines":   true,
+		"/gc/pauses:seconds":             true,
+		"/memory/classes/total:bytes":    true,
+		"/cpu/classes/total:cpu-seconds": true,
+	}
+	opts := &Options{
+		Filter: func(name string) bool { return include[name] },
+		Tags:   cgm.Tags{{Category: "app", Value: "test"}},
+	}
+
+	Register(cm, opts)
+
+	runtime.GC()
+
+	output := *cm.FlushMetrics()
+
+	name := func(n string) string {
+		return cm.MetricNameWithStreamTags(n, opts.Tags)
+	}
+
+	for n, mt := range map[string]string{
+		"go_gc_cycles_total_gc_cycles":     cgm.MetricTypeUint64,
+		"go_sched_goroutines_goroutines":   cgm.MetricTypeUint64,
+		"go_gc_pauses_seconds":             cgm.MetricTypeHistogram,
+		"go_memory_classes_total_bytes":    cgm.MetricTypeUint64,
+		"go_cpu_classes_total_cpu_seconds": cgm.MetricTypeFloat64, // cumulative, published as a gauge
+	} {
+		metric, ok := output[name(n)]
+		if !ok {
+			t.Fatalf("expected %s in %v", n, output)
+		}
+		if metric.Type != mt {
+			t.Fatalf("%s expected type %s, got %s", n, mt, metric.Type)
+		}
+	}
+
+	if v := output[name("go_gc_cycles_total_gc_cycles")].Value.(uint64); v == 0 {
+		t.Fatal("expected gc cycles")
+	}
+
+	Unregister(cm, opts)
+
+	if output := *cm.FlushMetrics(); len(output) != 0 {
+		t.Fatalf("expected no metrics, got %v", output)
+	}
+}
+
+func TestHistogramDelta(t *testing.T) {
+	d := &histogramDelta{}
+
+	h := &metrics.Float64Histogram{
+		Counts:  []uint64{1, 0, 2},
+		Buckets: []float64{math.Inf(-1), 1, 2, math.Inf(1)},
+	}
+
+	hist := d.next(h)
+	if hist == nil || hist.Count() != 3 {
+		t.Fatalf("expected 3 samples, got %v", hist)
+	}
+	if v := hist.Min(); v != 1 {
+		t.Fatalf("expected min 1, got %v", v)
+	}
+
+	if hist := d.next(h); hist != nil {
+		t.Fatalf("expected no new samples, got %v", hist.DecStrings())
+	}
+
+	h.Counts = []uint64{1, 4, 2}
+	hist = d.next(h)
+	if hist == nil || hist.Count() != 4 {
+		t.Fatalf("expected 4 samples, got %v", hist)
+	}
+	if v := hist.Mean(); math.Abs(v-1.5) > 0.1 {
+		t.Fatalf("expected samples at bucket midpoint 1.5, got %v", v)
+	}
+
+	if hist := d.next(nil); hist != nil {
+		t.Fatal("expected nil")
+	}
+}
+
+func TestMetricName(t *testing.T) {
+	tests := map[string]string{
+		"/gc/heap/allocs:bytes":             "go_gc_heap_allocs_bytes",
+		"/cpu/classes/gc/total:cpu-seconds": "go_cpu_classes_gc_total_cpu_seconds",
+	}
+	for in, expected := range tests {
+		if name := metricName("go", in); name != expected {
+			t.Fatalf("expected %s, got %s", expected, name)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSpoolMaxSize = "10485760" // 10MB
+	defaultSpoolMaxAge  = "1h"
+	spoolFileExt        = ".json"
+)
+
+// spool retains payloads which could not be submitted so they
+// can be replayed, oldest first, once the broker accepts metrics again.
+type spool struct {
+	dir     string
+	maxAge  time.Duration
+	maxSize int64
+	seq     uint64
+	mu      sync.Mutex
+}
+
+func newSpool(dir string, maxSize int64, maxAge time.Duration) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating spool directory")
+	}
+	return &spool{
+		dir:     dir,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}, nil
+}
+
+// write stores a payload, forcing timestamps on every metric so
+// the broker records the values at the time they were collected
+func (s *spool) write(output Metrics, ts time.Time) error {
+	stamp := makeTimestamp(ts)
+	spooled := make(Metrics, len(output))
+	for name, metric := range output {
+		if metric.Timestamp == 0 {
+			metric.Timestamp = stamp
+		}
+		spooled[name] = metric
+	}
+
+	data, err := json.Marshal(spooled)
+	if err != nil {
+		return errors.Wrap(err, "preparing spool payload")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d", ts.UnixNano(), s.seq%1000000)
+	tmpFile := filepath.Join(s.dir, "."+name)
+	if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+		return errors.Wrap(err, "writing spool file")
+	}
+	if err := os.Rename(tmpFile, filepath.Join(s.dir, name+spoolFileExt)); err != nil {
+		_ = os.Remove(tmpFile)
+		return errors.Wrap(err, "renaming spool file")
+	}
+
+	return s.prune()
+}
+
+// replay sends spooled payloads, oldest first, removing each one once it
+// has been accepted. Payloads which are rejected (malformed, or refused by
+// the broker with a 4xx status) are removed and reported to discard, replay
+// stops at the first payload which fails for any other reason. The lock is
+// only held while listing the spool, not while payloads are sent.
+func (s *spool) replay(send func([]byte) error, discard func(string, error)) (int, error) {
+	s.mu.Lock()
+	err := s.prune()
+	var files []os.FileInfo
+	if err == nil {
+		files, err = s.files()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, fi := range files {
+		file := filepath.Join(s.dir, fi.Name())
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // pruned by a concurrent write
+			}
+			return sent, errors.Wrap(err, "reading spool file")
+		}
+		if err := send(data); err != nil {
+			if !rejectedPayload(err) {
+				return sent, err
+			}
+			if discard != nil {
+				discard(fi.Name(), err)
+			}
+		} else {
+			sent++
+		}
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return sent, errors.Wrap(err, "removing spool file")
+		}
+	}
+
+	return sent, nil
+}
+
+// errMalformedSpool is returned for spool files which cannot be decoded
+var errMalformedSpool = errors.New("malformed spool file")
+
+// rejectedPayload returns whether err indicates a payload which will never
+// be accepted, retrying it would block the payloads spooled after it
+func rejectedPayload(err error) bool {
+	if errors.Is(err, errMalformedSpool) {
+		return true
+	}
+	var se *statusError
+	return errors.As(err, &se) && se.rejected()
+}
+
+// decodeSpooled decodes a spooled payload. Values are restored to the types
+// produced by a live flush (e.g. uint64 for counters, float64 for "n" gauges)
+// so Submitters see the same values whether metrics are sent live or replayed.
+func decodeSpooled(payload []byte) (Metrics, error) {
+	var output Metrics
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber() // retain exact values (e.g. uint64 counters)
+	if err := dec.Decode(&output); err != nil {
+		return nil, errors.Wrap(errMalformedSpool, err.Error())
+	}
+
+	for name, metric := range output {
+		num, ok := metric.Value.(json.Number)
+		if !ok {
+			continue
+		}
+		if v, ok := spooledValue(metric.Type, num); ok {
+			metric.Value = v
+			output[name] = metric
+		}
+	}
+
+	return output, nil
+}
+
+// spooledValue converts a number to the go type used for the metric type
+func spooledValue(metricType string, num json.Number) (interface{}, bool) {
+	s := num.String()
+	switch metricType {
+	case MetricTypeInt32:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return int32(v), err == nil
+	case MetricTypeUint32:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return uint32(v), err == nil
+	case MetricTypeInt64:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return v, err == nil
+	case MetricTypeUint64:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return v, err == nil
+	case MetricTypeFloat64:
+		v, err := strconv.ParseFloat(s, 64)
+		return v, err == nil
+	}
+	return nil, false
+}
+
+// prune removes spool files older than max age and, oldest first,
+// any files exceeding max size. Caller must hold the lock.
+func (s *spool) prune() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, fi := range files {
+		size += fi.Size()
+	}
+
+	for _, fi := range files {
+		expired := s.maxAge > 0 && time.Since(fi.ModTime()) > s.maxAge
+		oversize := s.maxSize > 0 && size > s.maxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(filepath.Join(s.dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "pruning spool file")
+		}
+		size -= fi.Size()
+	}
+
+	return nil
+}
+
+// files returns the spooled payloads sorted oldest first
+func (s *spool) files() ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading spool directory")
+	}
+
+	files := make([]os.FileInfo, 0, len(entries))
+	for _, fi := range entries {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), spoolFileExt) || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		files = append(files, fi)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	return files, nil
+}
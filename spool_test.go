@@ -0,0 +1,264 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgm-spool")
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newSpool(dir, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	ts := time.Now()
+
+	t.Log("write")
+	{
+		if err := s.write(Metrics{"foo": Metric{Type: "L", Value: 1}}, ts); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if err := s.write(Metrics{"bar": Metric{Type: "L", Value: 2, Timestamp: 1}}, ts.Add(time.Second)); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		files, err := s.files()
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if len(files) != 2 {
+			t.Fatalf("expected 2 spool files, got %d", len(files))
+		}
+	}
+
+	t.Log("replay failure")
+	{
+		sent, err := s.replay(func(payload []byte) error {
+			return errors.New("broker unavailable")
+		}, nil)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if sent != 0 {
+			t.Fatalf("expected 0 sent, got %d", sent)
+		}
+	}
+
+	t.Log("replay oldest first, timestamps forced")
+	{
+		var payloads []Metrics
+		sent, err := s.replay(func(payload []byte) error {
+			var m Metrics
+			if err := json.Unmarshal(payload, &m); err != nil {
+				return err
+			}
+			payloads = append(payloads, m)
+			return nil
+		}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if sent != 2 {
+			t.Fatalf("expected 2 sent, got %d", sent)
+		}
+		if _, ok := payloads[0]["foo"]; !ok {
+			t.Fatalf("expected foo first, got %v", payloads)
+		}
+		if payloads[0]["foo"].Timestamp != makeTimestamp(ts) {
+			t.Fatalf("expected ts %d, got %d", makeTimestamp(ts), payloads[0]["foo"].Timestamp)
+		}
+		if payloads[1]["bar"].Timestamp != 1 {
+			t.Fatalf("expected existing ts to be kept, got %d", payloads[1]["bar"].Timestamp)
+		}
+		files, err := s.files()
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("expected 0 spool files, got %d", len(files))
+		}
+	}
+
+	t.Log("rejected payloads are discarded, lock released while sending")
+	{
+		for i := 0; i < 3; i++ {
+			if err := s.write(Metrics{"foo": Metric{Type: "L", Value: i}}, ts.Add(time.Duration(i)*time.Second)); err != nil {
+				t.Fatalf("unexpected error (%s)", err)
+			}
+		}
+		calls := 0
+		var discarded []string
+		sent, err := s.replay(func(payload []byte) error {
+			calls++
+			if calls == 1 {
+				// writing while replaying must not block
+				if err := s.write(Metrics{"bar": Metric{Type: "L", Value: 1}}, ts.Add(time.Hour)); err != nil {
+					t.Fatalf("unexpected error (%s)", err)
+				}
+				return &statusError{code: http.StatusUnsupportedMediaType}
+			}
+			if calls == 2 {
+				return &statusError{code: http.StatusServiceUnavailable}
+			}
+			return nil
+		}, func(file string, err error) {
+			discarded = append(discarded, file)
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		if sent != 0 || len(discarded) != 1 {
+			t.Fatalf("expected 0 sent and 1 discarded, got %d %v", sent, discarded)
+		}
+		files, err := s.files()
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if len(files) != 3 {
+			t.Fatalf("expected 3 spool files, got %d", len(files))
+		}
+
+		sent, err = s.replay(func(payload []byte) error { return nil }, nil)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if sent != 3 {
+			t.Fatalf("expected 3 sent, got %d", sent)
+		}
+	}
+
+	t.Log("max size")
+	{
+		s.maxSize = 1
+		if err := s.write(Metrics{"foo": Metric{Type: "L", Value: 1}}, ts); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		files, err := s.files()
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("expected 0 spool files, got %d", len(files))
+		}
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgm-spool")
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var accept, received uint64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadUint64(&accept) == 0 {
+			w.WriteHeader(400)
+			fmt.Fprintln(w, `{"error":"unavailable"}`)
+			return
+		}
+		atomic.AddUint64(&received, 1)
+		w.WriteHeader(200)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"stats":1}`)
+	}))
+	defer server.Close()
+
+	cfg := &Config{
+		Interval: "0",
+		SpoolDir: dir,
+	}
+	cfg.CheckManager.Check.SubmissionURL = server.URL
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	cm.Increment("foo")
+	if _, err := cm.FlushContext(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+
+	files, err := cm.spool.files()
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 spool file, got %d", len(files))
+	}
+
+	atomic.StoreUint64(&accept, 1)
+
+	cm.Increment("foo")
+	if _, err := cm.FlushContext(context.Background()); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if n := atomic.LoadUint64(&received); n != 2 {
+		t.Fatalf("expected 2 submissions, got %d", n)
+	}
+
+	files, err = cm.spool.files()
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected 0 spool files, got %d", len(files))
+	}
+}
+
+func TestDecodeSpooled(t *testing.T) {
+	payload, err := json.Marshal(Metrics{
+		"i": Metric{Type: "i", Value: int32(-1)},
+		"I": Metric{Type: "I", Value: uint32(1)},
+		"l": Metric{Type: "l", Value: int64(-2)},
+		"L": Metric{Type: "L", Value: uint64(18446744073709551615)},
+		"n": Metric{Type: "n", Value: 1.5},
+		"s": Metric{Type: "s", Value: "text"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output, err := decodeSpooled(payload)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	expected := map[string]interface{}{
+		"i": int32(-1),
+		"I": uint32(1),
+		"l": int64(-2),
+		"L": uint64(18446744073709551615),
+		"n": float64(1.5),
+		"s": "text",
+	}
+	for name, value := range expected {
+		if output[name].Value != value {
+			t.Fatalf("%s expected %v (%T), got %v (%T)", name, value, value, output[name].Value, output[name].Value)
+		}
+	}
+
+	if _, err := decodeSpooled([]byte("{")); !rejectedPayload(err) {
+		t.Fatalf("expected malformed payload to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,401 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sqlmetrics provides database/sql instrumentation for circonus-gometrics
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql/driver"
+	"time"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+	"github.com/pkg/errors"
+)
+
+const defaultPrefix = "sql"
+
+// operations, used to tag metrics
+const (
+	opBegin    = "begin"
+	opCommit   = "commit"
+	opExec     = "exec"
+	opPrepare  = "prepare"
+	opQuery    = "query"
+	opRollback = "rollback"
+)
+
+// Options for the instrumented driver
+type Options struct {
+	// Prefix for metric names, default "sql"
+	Prefix string
+
+	// QueryNameFunc returns the name used to tag metrics for a query. It must
+	// return a bounded set of names (e.g. "get_user" rather than the query text)
+	// to keep the number of metric streams under control. If not set, or the
+	// name returned is empty, metrics are not tagged with a query name.
+	QueryNameFunc func(query string) string
+
+	// Tags identifying the database (e.g. db:users), use distinct tags
+	// (or prefix) when instrumenting more than one database
+	Tags cgm.Tags
+}
+
+// Metrics recorded by the driver (each tagged with the Options.Tags):
+//
+//   <prefix>_duration       histogram (seconds), tagged op, query
+//   <prefix>_errors         counter, tagged op, query
+//   <prefix>_rows_affected  histogram, tagged op (exec), query
+//
+// The op tag is one of begin, commit, exec, prepare, query or rollback. The
+// duration of a query is the time until the rows are returned, it does not
+// include iterating over the rows.
+
+// recorder records metrics for database operations
+type recorder struct {
+	m    *cgm.CirconusMetrics
+	opts Options
+}
+
+func newRecorder(m *cgm.CirconusMetrics, opts *Options) *recorder {
+	r := &recorder{m: m}
+	if opts != nil {
+		r.opts = *opts
+	}
+	if r.opts.Prefix == "" {
+		r.opts.Prefix = defaultPrefix
+	}
+	return r
+}
+
+// tags returns the tags for an operation on query
+func (r *recorder) tags(op, query string) cgm.Tags {
+	tags := make(cgm.Tags, 0, len(r.opts.Tags)+2)
+	tags = append(tags, r.opts.Tags...)
+	tags = append(tags, cgm.Tag{Category: "op", Value: op})
+	if query != "" && r.opts.QueryNameFunc != nil {
+		if name := r.opts.QueryNameFunc(query); name != "" {
+			tags = append(tags, cgm.Tag{Category: "query", Value: name})
+		}
+	}
+	return tags
+}
+
+// record records the duration of an operation and, if it failed, the error.
+// driver.ErrSkip is not an error, the operation is retried another way.
+func (r *recorder) record(op, query string, start time.Time, err error) {
+	if errors.Is(err, driver.ErrSkip) {
+		return
+	}
+	tags := r.tags(op, query)
+	r.m.RecordDurationWithTags(r.opts.Prefix+"_duration", tags, time.Since(start))
+	if err != nil {
+		r.m.IncrementWithTags(r.opts.Prefix+"_errors", tags)
+	}
+}
+
+// recordResult records the rows affected by an exec
+func (r *recorder) recordResult(query string, res driver.Result) {
+	if res == nil {
+		return
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		r.m.RecordValueWithTags(r.opts.Prefix+"_rows_affected", r.tags(opExec, query), float64(n))
+	}
+}
+
+// instrumentedDriver wraps a driver.Driver
+type instrumentedDriver struct {
+	driver.Driver
+	r *recorder
+}
+
+// WrapDriver returns a driver.Driver recording metrics for the operations
+// of d, register it with sql.Register to use it with sql.Open.
+func WrapDriver(m *cgm.CirconusMetrics, d driver.Driver, opts *Options) driver.Driver {
+	return &instrumentedDriver{Driver: d, r: newRecorder(m, opts)}
+}
+
+// Open implements driver.Driver
+func (d *instrumentedDriver) Open(name string) (driver.Conn, error) {
+	c, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, r: d.r}, nil
+}
+
+// instrumentedConnector wraps a driver.Connector
+type instrumentedConnector struct {
+	connector driver.Connector
+	r         *recorder
+}
+
+// WrapConnector returns a driver.Connector recording metrics for the
+// operations of c, use it with sql.OpenDB.
+func WrapConnector(m *cgm.CirconusMetrics, c driver.Connector, opts *Options) driver.Connector {
+	return &instrumentedConnector{connector: c, r: newRecorder(m, opts)}
+}
+
+// Connect implements driver.Connector
+func (c *instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	dc, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: dc, r: c.r}, nil
+}
+
+// Driver implements driver.Connector
+func (c *instrumentedConnector) Driver() driver.Driver {
+	return &instrumentedDriver{Driver: c.connector.Driver(), r: c.r}
+}
+
+// conn wraps a driver.Conn, the optional interfaces are passed through to
+// the wrapped connection, returning driver.ErrSkip (or the database/sql
+// default) when they are not implemented.
+type conn struct {
+	driver.Conn
+	r *recorder
+}
+
+// Prepare implements driver.Conn
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext implements driver.ConnPrepareContext
+func (c *conn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	start := time.Now()
+	var s driver.Stmt
+	var err error
+	if cpc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		s, err = cpc.PrepareContext(ctx, query)
+	} else {
+		s, err = c.Conn.Prepare(query)
+	}
+	c.r.record(opPrepare, query, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &stmt{Stmt: s, conn: c.Conn, query: query, r: c.r}, nil
+}
+
+// Begin implements driver.Conn
+func (c *conn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx implements driver.ConnBeginTx
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var dtx driver.Tx
+	var err error
+	if cbt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		dtx, err = cbt.BeginTx(ctx, opts)
+	} else if opts.Isolation != 0 || opts.ReadOnly {
+		err = errors.New("sqlmetrics: driver does not support non-default transaction options")
+	} else {
+		dtx, err = c.Conn.Begin()
+	}
+	c.r.record(opBegin, "", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &tx{Tx: dtx, r: c.r}, nil
+}
+
+// ExecContext implements driver.ExecerContext
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var res driver.Result
+	var err error
+	switch ec := c.Conn.(type) {
+	case driver.ExecerContext:
+		res, err = ec.ExecContext(ctx, query, args)
+	case driver.Execer:
+		var vals []driver.Value
+		if vals, err = namedValuesToValues(args); err == nil {
+			res, err = ec.Exec(query, vals)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.r.record(opExec, query, start, err)
+	if err == nil {
+		c.r.recordResult(query, res)
+	}
+	return res, err
+}
+
+// QueryContext implements driver.QueryerContext
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	switch qc := c.Conn.(type) {
+	case driver.QueryerContext:
+		rows, err = qc.QueryContext(ctx, query, args)
+	case driver.Queryer:
+		var vals []driver.Value
+		if vals, err = namedValuesToValues(args); err == nil {
+			rows, err = qc.Query(query, vals)
+		}
+	default:
+		return nil, driver.ErrSkip
+	}
+	c.r.record(opQuery, query, start, err)
+	return rows, err
+}
+
+// Ping implements driver.Pinger
+func (c *conn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// ResetSession implements driver.SessionResetter
+func (c *conn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator
+func (c *conn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue implements driver.NamedValueChecker
+func (c *conn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// stmt wraps a driver.Stmt, conn is the wrapped connection which prepared it
+type stmt struct {
+	driver.Stmt
+	conn  driver.Conn
+	query string
+	r     *recorder
+}
+
+// Exec implements driver.Stmt
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	start := time.Now()
+	res, err := s.Stmt.Exec(args)
+	s.r.record(opExec, s.query, start, err)
+	if err == nil {
+		s.r.recordResult(s.query, res)
+	}
+	return res, err
+}
+
+// Query implements driver.Stmt
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.Query(args)
+	s.r.record(opQuery, s.query, start, err)
+	return rows, err
+}
+
+// ExecContext implements driver.StmtExecContext
+func (s *stmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	sec, ok := s.Stmt.(driver.StmtExecContext)
+	if !ok {
+		vals, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Exec(vals)
+	}
+	start := time.Now()
+	res, err := sec.ExecContext(ctx, args)
+	s.r.record(opExec, s.query, start, err)
+	if err == nil {
+		s.r.recordResult(s.query, res)
+	}
+	return res, err
+}
+
+// QueryContext implements driver.StmtQueryContext
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	sqc, ok := s.Stmt.(driver.StmtQueryContext)
+	if !ok {
+		vals, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		return s.Query(vals)
+	}
+	start := time.Now()
+	rows, err := sqc.QueryContext(ctx, args)
+	s.r.record(opQuery, s.query, start, err)
+	return rows, err
+}
+
+// CheckNamedValue implements driver.NamedValueChecker, database/sql only
+// consults the connection's checker when the statement has none so fall
+// back to it here
+func (s *stmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	if nvc, ok := s.conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// ColumnConverter implements driver.ColumnConverter, returning the
+// database/sql default converter if the wrapped statement has none
+func (s *stmt) ColumnConverter(idx int) driver.ValueConverter {
+	if cc, ok := s.Stmt.(driver.ColumnConverter); ok {
+		return cc.ColumnConverter(idx)
+	}
+	return driver.DefaultParameterConverter
+}
+
+// tx wraps a driver.Tx
+type tx struct {
+	driver.Tx
+	r *recorder
+}
+
+// Commit implements driver.Tx
+func (t *tx) Commit() error {
+	start := time.Now()
+	err := t.Tx.Commit()
+	t.r.record(opCommit, "", start, err)
+	return err
+}
+
+// Rollback implements driver.Tx
+func (t *tx) Rollback() error {
+	start := time.Now()
+	err := t.Tx.Rollback()
+	t.r.record(opRollback, "", start, err)
+	return err
+}
+
+// namedValuesToValues converts arguments for drivers which do not support
+// the context methods, which also do not support named arguments
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sqlmetrics: driver does not support named arguments")
+		}
+		vals[i] = arg.Value
+	}
+	return vals, nil
+}
@@ -0,0 +1,428 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlmetrics
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+// fake in-memory driver, statements containing "fail" return an error,
+// execs affect 3 rows and queries return 2 rows
+
+var errFake = errors.New("fake failure")
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{}, nil }
+
+type fakeConnector struct{}
+
+func (fakeConnector) Connect(context.Context) (driver.Conn, error) { return &fakeConn{}, nil }
+func (fakeConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeConn struct{}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errFake
+	}
+	return &fakeStmt{query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeStmt struct {
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(3), nil
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &fakeRows{}, nil
+}
+
+// fakeExecConn supports exec and query without preparing a statement
+type fakeExecConn struct {
+	fakeConn
+}
+
+func (c *fakeExecConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errFake
+	}
+	return driver.RowsAffected(3), nil
+}
+func (c *fakeExecConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if strings.Contains(query, "fail") {
+		return nil, errFake
+	}
+	return &fakeRows{}, nil
+}
+
+type fakeExecConnector struct{}
+
+func (fakeExecConnector) Connect(context.Context) (driver.Conn, error) { return &fakeExecConn{}, nil }
+func (fakeExecConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+// fakeCheckedConn implements driver.Validator and driver.NamedValueChecker,
+// accepting point arguments, its statements upper case string arguments
+type fakeCheckedConn struct {
+	fakeConn
+	valid bool
+	args  []driver.Value
+}
+
+type point struct{ x, y int }
+
+func (c *fakeCheckedConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeConvertStmt{fakeStmt: fakeStmt{query: query}, conn: c}, nil
+}
+func (c *fakeCheckedConn) IsValid() bool { return c.valid }
+func (c *fakeCheckedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if p, ok := nv.Value.(point); ok {
+		nv.Value = fmt.Sprintf("%d,%d", p.x, p.y)
+		return nil
+	}
+	return driver.ErrSkip
+}
+
+type fakeConvertStmt struct {
+	fakeStmt
+	conn *fakeCheckedConn
+}
+
+func (s *fakeConvertStmt) ColumnConverter(idx int) driver.ValueConverter { return upperConverter{} }
+func (s *fakeConvertStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.args = args
+	return driver.RowsAffected(1), nil
+}
+
+type upperConverter struct{}
+
+func (upperConverter) ConvertValue(v interface{}) (driver.Value, error) {
+	if s, ok := v.(string); ok {
+		return strings.ToUpper(s), nil
+	}
+	return driver.DefaultParameterConverter.ConvertValue(v)
+}
+
+type fakeCheckedConnector struct {
+	conn *fakeCheckedConn
+}
+
+func (c fakeCheckedConnector) Connect(context.Context) (driver.Conn, error) { return c.conn, nil }
+func (c fakeCheckedConnector) Driver() driver.Driver                        { return fakeDriver{} }
+
+type fakeRows struct {
+	n int
+}
+
+func (r *fakeRows) Columns() []string { return []string{"id"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.n == 2 {
+		return io.EOF
+	}
+	r.n++
+	dest[0] = int64(r.n)
+	return nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+func testOptions() *Options {
+	return &Options{
+		Tags: cgm.Tags{{Category: "db", Value: "test"}},
+		QueryNameFunc: func(query string) string {
+			return strings.ToLower(strings.Fields(query)[0])
+		},
+	}
+}
+
+func opTags(op, query string) cgm.Tags {
+	tags := cgm.Tags{{Category: "db", Value: "test"}, {Category: "op", Value: op}}
+	if query != "" {
+		tags = append(tags, cgm.Tag{Category: "query", Value: query})
+	}
+	return tags
+}
+
+func queryRows(t *testing.T, db *sql.DB, query string) int {
+	rows, err := db.Query(query)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n
+}
+
+func TestWrapConnector(t *testing.T) {
+	tests := []struct {
+		connector driver.Connector
+		execs     uint64 // failed execs are timed too, without exec support the prepare fails
+	}{
+		{fakeConnector{}, 1},
+		{fakeExecConnector{}, 2},
+	}
+
+	for _, test := range tests {
+		connector := test.connector
+		t.Logf("%T", connector)
+
+		cfg := &cgm.Config{}
+		cfg.CheckManager.Check.SubmissionURL = "none"
+		cfg.Interval = "0"
+
+		cm, err := cgm.New(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		db := sql.OpenDB(WrapConnector(cm, connector, testOptions()))
+
+		if _, err := db.Exec("INSERT foo"); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if _, err := db.Exec("INSERT fail"); err == nil {
+			t.Fatal("expected error")
+		}
+		if n := queryRows(t, db, "SELECT foo"); n != 2 {
+			t.Fatalf("expected 2 rows, got %d", n)
+		}
+
+		if c, err := cm.HistogramCount(cm.MetricNameWithStreamTags("sql_duration", opTags("exec", "insert"))); err != nil || c != test.execs {
+			t.Fatalf("expected %d execs, got %d (%v)", test.execs, c, err)
+		}
+		if c, err := cm.HistogramCount(cm.MetricNameWithStreamTags("sql_duration", opTags("query", "select"))); err != nil || c != 1 {
+			t.Fatalf("expected 1 query, got %d (%v)", c, err)
+		}
+		if v, err := cm.HistogramMin(cm.MetricNameWithStreamTags("sql_rows_affected", opTags("exec", "insert"))); err != nil || v != 3 {
+			t.Fatalf("expected 3 rows affected, got %v (%v)", v, err)
+		}
+
+		// failure is an exec error on a connection supporting exec, otherwise the prepare fails
+		failures := uint64(0)
+		for _, op := range []string{"exec", "prepare"} {
+			if v, err := cm.GetCounterTest(cm.MetricNameWithStreamTags("sql_errors", opTags(op, "insert"))); err == nil {
+				failures += v
+			}
+		}
+		if failures != 1 {
+			t.Fatalf("expected 1 error, got %d", failures)
+		}
+
+		db.Close()
+	}
+}
+
+func TestPreparedStatementsAndTransactions(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	db := sql.OpenDB(WrapConnector(cm, fakeExecConnector{}, testOptions()))
+	defer db.Close()
+
+	stmt, err := db.Prepare("UPDATE foo")
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := stmt.Exec(); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+	}
+	stmt.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	tx, err = db.Begin()
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	if _, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true}); err == nil {
+		t.Fatal("expected error, driver does not support transaction options")
+	}
+
+	tests := []struct {
+		op, query string
+		count     uint64
+	}{
+		{"prepare", "update", 1},
+		{"exec", "update", 2},
+		{"begin", "", 3},
+		{"commit", "", 1},
+		{"rollback", "", 1},
+	}
+	for _, test := range tests {
+		name := cm.MetricNameWithStreamTags("sql_duration", opTags(test.op, test.query))
+		if c, err := cm.HistogramCount(name); err != nil || c != test.count {
+			t.Fatalf("%s expected %d, got %d (%v)", test.op, test.count, c, err)
+		}
+	}
+
+	if v, err := cm.GetCounterTest(cm.MetricNameWithStreamTags("sql_errors", opTags("begin", ""))); err != nil || v != 1 {
+		t.Fatalf("expected 1 begin error, got %d (%v)", v, err)
+	}
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	fc := &fakeCheckedConn{valid: true}
+	db := sql.OpenDB(WrapConnector(cm, fakeCheckedConnector{conn: fc}, testOptions()))
+	defer db.Close()
+
+	t.Log("connection checker and statement column converter")
+	{
+		stmt, err := db.Prepare("INSERT foo")
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if _, err := stmt.Exec(point{1, 2}, "abc", 3); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		stmt.Close()
+
+		expected := []driver.Value{"1,2", "ABC", int64(3)}
+		if len(fc.args) != len(expected) {
+			t.Fatalf("expected %v, got %v", expected, fc.args)
+		}
+		for i := range expected {
+			if fc.args[i] != expected[i] {
+				t.Fatalf("expected %v, got %v", expected, fc.args)
+			}
+		}
+		if db.Stats().Idle != 1 {
+			t.Fatalf("expected 1 idle connection, got %d", db.Stats().Idle)
+		}
+	}
+
+	t.Log("invalid connection is not returned to the pool")
+	{
+		fc.valid = false
+		if err := db.Ping(); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if db.Stats().Idle != 0 {
+			t.Fatalf("expected no idle connections, got %d", db.Stats().Idle)
+		}
+	}
+}
+
+func TestWrapDriver(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	sql.Register("sqlmetrics-fake", WrapDriver(cm, fakeDriver{}, &Options{Prefix: "fakedb"}))
+
+	db, err := sql.Open("sqlmetrics-fake", "")
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	defer db.Close()
+
+	if n := queryRows(t, db, "SELECT foo"); n != 2 {
+		t.Fatalf("expected 2 rows, got %d", n)
+	}
+
+	name := cm.MetricNameWithStreamTags("fakedb_duration", cgm.Tags{{Category: "op", Value: "query"}})
+	if c, err := cm.HistogramCount(name); err != nil || c != 1 {
+		t.Fatalf("expected 1, got %d (%v)", c, err)
+	}
+}
+
+func TestRegisterDBStats(t *testing.T) {
+	cfg := &cgm.Config{}
+	cfg.CheckManager.Check.SubmissionURL = "none"
+	cfg.Interval = "0"
+
+	cm, err := cgm.New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	opts := testOptions()
+	db := sql.OpenDB(WrapConnector(cm, fakeConnector{}, opts))
+	defer db.Close()
+
+	db.SetMaxOpenConns(5)
+	if err := db.Ping(); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	RegisterDBStats(cm, db, opts)
+
+	metrics := *cm.FlushMetricsNoReset()
+	tags := cgm.Tags{{Category: "db", Value: "test"}}
+
+	expected := map[string]interface{}{
+		"sql_max_open_connections": int64(5),
+		"sql_open_connections":     int64(1),
+		"sql_in_use_connections":   int64(0),
+		"sql_idle_connections":     int64(1),
+		"sql_wait_count":           int64(0),
+		"sql_wait_duration":        float64(0),
+	}
+	for name, value := range expected {
+		metric, ok := metrics[cm.MetricNameWithStreamTags(name, tags)]
+		if !ok {
+			t.Fatalf("expected %s", name)
+		}
+		if metric.Value != value {
+			t.Fatalf("%s expected %v (%T), got %v (%T)", name, value, value, metric.Value, metric.Value)
+		}
+	}
+
+	UnregisterDBStats(cm, opts)
+
+	if metrics := *cm.FlushMetricsNoReset(); len(metrics) != 0 {
+		t.Fatalf("expected no metrics, got %v", metrics)
+	}
+}
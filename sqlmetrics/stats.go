@@ -0,0 +1,61 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sqlmetrics
+
+import (
+	"database/sql"
+
+	cgm "github.com/circonus-labs/circonus-gometrics/v3"
+)
+
+// Connection pool gauges (each tagged with the Options.Tags):
+//
+//	<prefix>_max_open_connections  maximum number of open connections
+//	<prefix>_open_connections      connections in use and idle
+//	<prefix>_in_use_connections    connections in use
+//	<prefix>_idle_connections      idle connections
+//	<prefix>_wait_count            total number of connections waited for
+//	<prefix>_wait_duration         total time (seconds) waited for connections
+var dbStatsGauges = []struct {
+	name string
+	fn   func(sql.DBStats) int64
+}{
+	{"max_open_connections", func(s sql.DBStats) int64 { return int64(s.MaxOpenConnections) }},
+	{"open_connections", func(s sql.DBStats) int64 { return int64(s.OpenConnections) }},
+	{"in_use_connections", func(s sql.DBStats) int64 { return int64(s.InUse) }},
+	{"idle_connections", func(s sql.DBStats) int64 { return int64(s.Idle) }},
+	{"wait_count", func(s sql.DBStats) int64 { return s.WaitCount }},
+}
+
+const waitDurationGauge = "wait_duration"
+
+// RegisterDBStats registers gauge functions sampling the connection pool
+// statistics of db at each flush.
+func RegisterDBStats(m *cgm.CirconusMetrics, db *sql.DB, opts *Options) {
+	r := newRecorder(m, opts)
+
+	for _, g := range dbStatsGauges {
+		fn := g.fn
+		m.SetGaugeFuncWithTags(r.opts.Prefix+"_"+g.name, r.opts.Tags, func() int64 {
+			return fn(db.Stats())
+		})
+	}
+
+	m.SetGaugeFuncFloat64WithTags(r.opts.Prefix+"_"+waitDurationGauge, r.opts.Tags, func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+}
+
+// UnregisterDBStats stops sampling the pool statistics of the database
+// registered with the same Prefix and Tags.
+func UnregisterDBStats(m *cgm.CirconusMetrics, opts *Options) {
+	r := newRecorder(m, opts)
+
+	for _, g := range dbStatsGauges {
+		m.RemoveGaugeFuncWithTags(r.opts.Prefix+"_"+g.name, r.opts.Tags)
+	}
+
+	m.RemoveGaugeFuncWithTags(r.opts.Prefix+"_"+waitDurationGauge, r.opts.Tags)
+}
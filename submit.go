@@ -6,6 +6,8 @@ package circonusgometrics
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -14,49 +16,112 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/circonus-labs/circonus-gometrics/v3/checkmgr"
 	"github.com/circonus-labs/go-apiclient"
 	"github.com/hashicorp/go-retryablehttp"
 	"github.com/pkg/errors"
 )
 
-type trapResult struct {
-	Error    string        `json:"error,omitempty"`
-	Duration time.Duration // doesn't come from broker
-	Filtered uint64        `json:"filtered,omitempty"`
-	Stats    uint64        `json:"stats"`
+// SubmitResult describes the outcome of a metric submission
+type SubmitResult struct {
+	Error        string        `json:"error,omitempty"`
+	Duration     time.Duration `json:"-"` // doesn't come from broker
+	Filtered     uint64        `json:"filtered,omitempty"`
+	Stats        uint64        `json:"stats"`
+	Attempts     int           `json:"-"` // number of requests made (including retries)
+	StatusCode   int           `json:"-"` // http status code of the final response
+	PayloadBytes int           `json:"-"` // size of the submitted payload
+	Requests     int           `json:"-"` // number of requests the metrics were split into
 }
 
-func (tr *trapResult) String() string {
-	ret := fmt.Sprintf("stats: %d, filtered: %d", tr.Stats, tr.Filtered)
-	if tr.Error != "" {
-		ret += ", error: " + tr.Error
+// add aggregates the result of one request into sr
+func (sr *SubmitResult) add(r *SubmitResult) {
+	if r == nil {
+		return
 	}
-	return ret
+	if r.Error != "" {
+		if sr.Error != "" {
+			sr.Error += "; "
+		}
+		sr.Error += r.Error
+	}
+	if r.Duration > sr.Duration {
+		sr.Duration = r.Duration
+	}
+	if r.StatusCode > sr.StatusCode {
+		sr.StatusCode = r.StatusCode
+	}
+	sr.Filtered += r.Filtered
+	sr.Stats += r.Stats
+	sr.Attempts += r.Attempts
+	sr.PayloadBytes += r.PayloadBytes
+	requests := r.Requests
+	if requests == 0 {
+		requests = 1
+	}
+	sr.Requests += requests
 }
-func (m *CirconusMetrics) submit(output Metrics, newMetrics map[string]*apiclient.CheckBundleMetric) {
 
-	// if there is nowhere to send metrics to, just return.
-	if !m.check.IsReady() {
-		m.Log.Printf("check not ready, skipping metric submission")
-		return
+func (sr *SubmitResult) String() string {
+	ret := fmt.Sprintf("stats: %d, filtered: %d", sr.Stats, sr.Filtered)
+	if sr.Error != "" {
+		ret += ", error: " + sr.Error
 	}
+	return ret
+}
 
-	// update check if there are any new metrics or, if metric tags have been added since last submit
-	m.check.UpdateCheck(newMetrics)
+// Submitter delivers packaged metrics to a destination. The default
+// Submitter sends metrics to the check's submission url (a broker httptrap
+// or a circonus-agent), supply a custom Submitter via Config to send
+// metrics elsewhere (e.g. a file, a message queue or a test recorder).
+// When spooling is enabled, payloads which failed are replayed through the
+// same Submitter with the Timestamp of each metric set, values have the
+// same types as in a live flush.
+type Submitter interface {
+	Submit(ctx context.Context, metrics Metrics) (*SubmitResult, error)
+}
+
+// statusError is returned when the broker responds with an unexpected status code
+type statusError struct {
+	body string
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad response code: %d (%s)", e.code, e.body)
+}
+
+// rejected returns whether the payload was refused outright (4xx, other than
+// timeouts and rate limiting) and will not be accepted if sent again
+func (e *statusError) rejected() bool {
+	return e.code >= 400 && e.code < 500 &&
+		e.code != http.StatusRequestTimeout && e.code != http.StatusTooManyRequests
+}
+
+// trapSubmitter is the default Submitter, sending metrics to the
+// submission url provided by the check manager
+type trapSubmitter struct {
+	m *CirconusMetrics
+}
+
+// Submit sends metrics to the broker (or circonus-agent)
+func (ts *trapSubmitter) Submit(ctx context.Context, output Metrics) (*SubmitResult, error) {
+	m := ts.m
 
 	str, err := json.Marshal(output)
 	if err != nil {
-		m.Log.Printf("error preparing metrics %s", err)
-		return
+		return nil, errors.Wrap(err, "preparing metrics")
 	}
 
-	result, err := m.trapCall(str)
+	result, err := m.trapCall(ctx, str)
 	if err != nil {
-		m.Log.Printf("error sending metrics - %s\n", err)
-		return
+		return nil, err
 	}
 
 	// OK response from circonus-agent does not
@@ -84,15 +149,264 @@ func (m *CirconusMetrics) submit(output Metrics, newMetrics map[string]*apiclien
 			m.Log.Printf(msg+" duration: %s", result.Duration.String())
 		}
 	}
+
+	return result, nil
+}
+
+func (m *CirconusMetrics) submit(ctx context.Context, output Metrics, newMetrics map[string]*apiclient.CheckBundleMetric) (*SubmitResult, error) {
+
+	// if there is nowhere to send metrics to, just return.
+	if m.check != nil && !m.check.IsReady() {
+		m.Log.Printf("check not ready, skipping metric submission")
+		return nil, errors.New("check not ready, skipping metric submission")
+	}
+
+	submitted := time.Now()
+
+	// update check if there are any new metrics or, if metric tags have been added since last submit
+	if m.check != nil {
+		m.check.UpdateCheck(newMetrics)
+	}
+
+	chunks := m.splitMetrics(output)
+	results := make([]*SubmitResult, len(chunks))
+	errs := make([]error, len(chunks))
+
+	if len(chunks) == 1 {
+		results[0], errs[0] = m.submitter.Submit(ctx, chunks[0])
+	} else {
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, m.submitConcurrency)
+		for i := range chunks {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				results[i], errs[i] = m.submitter.Submit(ctx, chunks[i])
+				<-sem
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	result := &SubmitResult{}
+	var errMsgs []string
+	for i, err := range errs {
+		if err != nil {
+			m.Log.Printf("error sending metrics - %s\n", err)
+			errMsgs = append(errMsgs, err.Error())
+			if m.spool != nil {
+				if serr := m.spool.write(chunks[i], submitted); serr != nil {
+					m.Log.Printf("error spooling metrics - %s\n", serr)
+				}
+			}
+			continue
+		}
+		result.add(results[i])
+	}
+
+	if len(errMsgs) == len(chunks) {
+		if len(chunks) == 1 {
+			return nil, errors.Wrap(errs[0], "sending metrics")
+		}
+		return nil, errors.Wrap(errors.New(strings.Join(errMsgs, "; ")), "sending metrics")
+	}
+
+	if m.spool != nil {
+		m.replaySpool(ctx)
+	}
+
+	if len(errMsgs) > 0 {
+		return result, errors.Wrapf(errors.New(strings.Join(errMsgs, "; ")), "sending metrics (%d of %d requests failed)", len(errMsgs), len(chunks))
+	}
+
+	return result, nil
+}
+
+// splitMetrics splits output into chunks honoring the maximum number of
+// metrics and maximum bytes per request. A single metric exceeding the
+// maximum bytes is sent in a request of its own.
+func (m *CirconusMetrics) splitMetrics(output Metrics) []Metrics {
+	if (m.maxMetricsPerRequest == 0 || len(output) <= m.maxMetricsPerRequest) && m.maxBytesPerRequest == 0 {
+		return []Metrics{output}
+	}
+
+	names := make([]string, 0, len(output))
+	for name := range output {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	chunks := []Metrics{}
+	chunk := make(Metrics)
+	size := 2 // {}
+	for _, name := range names {
+		metric := output[name]
+		msize := 0
+		if m.maxBytesPerRequest > 0 {
+			data, err := json.Marshal(metric)
+			if err != nil {
+				m.Log.Printf("error preparing metric %s: %s", name, err)
+				continue
+			}
+			msize = len(strconv.Quote(name)) + len(data) + 2 // name:value,
+		}
+		full := m.maxMetricsPerRequest > 0 && len(chunk) >= m.maxMetricsPerRequest
+		tooBig := m.maxBytesPerRequest > 0 && size+msize > m.maxBytesPerRequest
+		if len(chunk) > 0 && (full || tooBig) {
+			chunks = append(chunks, chunk)
+			chunk = make(Metrics)
+			size = 2
+		}
+		chunk[name] = metric
+		size += msize
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// replaySpool sends any spooled payloads now that metrics are being accepted
+func (m *CirconusMetrics) replaySpool(ctx context.Context) {
+	sent, err := m.spool.replay(func(payload []byte) error {
+		output, err := decodeSpooled(payload)
+		if err != nil {
+			return err
+		}
+		_, err = m.submitter.Submit(ctx, output)
+		return err
+	}, func(file string, err error) {
+		m.Log.Printf("discarding rejected spool file %s - %s\n", file, err)
+	})
+	if err != nil {
+		m.Log.Printf("error replaying spooled metrics - %s\n", err)
+	}
+	if m.Debug && sent > 0 {
+		m.Log.Printf("replayed %d spooled payload(s)", sent)
+	}
+}
+
+// trapHTTPClient returns the http client for the trap, a new client is only
+// created when the trap changes (e.g. the submission url is refreshed) so
+// connections to the broker are reused across submissions.
+func (m *CirconusMetrics) trapHTTPClient(trap *checkmgr.Trap) (*http.Client, error) {
+	m.trapcm.Lock()
+	defer m.trapcm.Unlock()
+
+	if m.trapClient != nil && m.trap == trap {
+		return m.trapClient, nil
+	}
+
+	keepAlives := m.trapMaxIdleConns > 0
+
+	client := &http.Client{}
+	switch {
+	case trap.URL.Scheme == "https":
+		client.Transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:       10 * time.Second,
+				KeepAlive:     30 * time.Second,
+				FallbackDelay: -1 * time.Millisecond,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     trap.TLS,
+			DisableKeepAlives:   !keepAlives,
+			MaxIdleConns:        m.trapMaxIdleConns,
+			MaxIdleConnsPerHost: m.trapMaxIdleConns,
+			IdleConnTimeout:     m.trapIdleConnTimeout,
+			DisableCompression:  false,
+		}
+	case trap.URL.Scheme == "http":
+		client.Transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:       10 * time.Second,
+				KeepAlive:     30 * time.Second,
+				FallbackDelay: -1 * time.Millisecond,
+			}).DialContext,
+			DisableKeepAlives:   !keepAlives,
+			MaxIdleConns:        m.trapMaxIdleConns,
+			MaxIdleConnsPerHost: m.trapMaxIdleConns,
+			IdleConnTimeout:     m.trapIdleConnTimeout,
+			DisableCompression:  false,
+		}
+	case trap.IsSocket:
+		m.Log.Printf("using socket transport\n")
+		client.Transport = trap.SockTransport
+	default:
+		return nil, fmt.Errorf("unknown scheme (%s), skipping submission", trap.URL.Scheme)
+	}
+
+	// release connections held by the client for the previous trap
+	if m.trapClient != nil {
+		m.trapClient.CloseIdleConnections()
+	}
+
+	m.trap = trap
+	m.trapClient = client
+	m.trapCompressionOff = false // new trap, may accept compressed payloads
+
+	return client, nil
+}
+
+// trapEncoding returns the content encoding to use for trap payloads
+func (m *CirconusMetrics) trapEncoding() string {
+	m.trapcm.Lock()
+	defer m.trapcm.Unlock()
+	if m.trapCompressionOff {
+		return ""
+	}
+	return m.trapCompression
 }
 
-func (m *CirconusMetrics) trapCall(payload []byte) (*trapResult, error) {
+// compressPayload compresses payload with the encoding (gzip or deflate) at level
+func compressPayload(payload []byte, encoding string, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+
+	switch encoding {
+	case compressionGzip:
+		w, err = gzip.NewWriterLevel(&buf, level)
+	case compressionDeflate:
+		w, err = zlib.NewWriterLevel(&buf, level)
+	default:
+		return nil, errors.Errorf("unknown encoding (%s)", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (m *CirconusMetrics) trapCall(ctx context.Context, payload []byte) (*SubmitResult, error) {
 	trap, err := m.check.GetSubmissionURL()
 	if err != nil {
 		return nil, errors.Wrap(err, "trap call")
 	}
 
-	dataReader := bytes.NewReader(payload)
+	// compress the payload, unless the broker has rejected compressed payloads
+	data := payload
+	encoding := m.trapEncoding()
+	if encoding != "" {
+		data, err = compressPayload(payload, encoding, m.trapCompressionLevel)
+		if err != nil {
+			return nil, errors.Wrap(err, "compressing payload")
+		}
+	}
+
+	dataReader := bytes.NewReader(data)
 
 	reqStart := time.Now()
 
@@ -100,12 +414,23 @@ func (m *CirconusMetrics) trapCall(payload []byte) (*trapResult, error) {
 	if err != nil {
 		return nil, err
 	}
+	httpClient, err := m.trapHTTPClient(trap)
+	if err != nil {
+		return nil, err
+	}
+
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
-	req.Header.Set("Connection", "close")
 	req.Header.Set("User-Agent", "cgm")
-	req.Header.Set("Content-Length", strconv.Itoa(len(payload)))
-	req.Close = true
+	req.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if m.trapMaxIdleConns == 0 {
+		req.Header.Set("Connection", "close")
+		req.Close = true
+	}
+	req = req.WithContext(ctx)
 
 	// keep last HTTP error in the event of retry failure
 	var lastHTTPError error
@@ -135,41 +460,7 @@ func (m *CirconusMetrics) trapCall(payload []byte) (*trapResult, error) {
 	}
 
 	client := retryablehttp.NewClient()
-	switch {
-	case trap.URL.Scheme == "https":
-		client.HTTPClient.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:       10 * time.Second,
-				KeepAlive:     3 * time.Second,
-				FallbackDelay: -1 * time.Millisecond,
-			}).DialContext,
-			TLSHandshakeTimeout: 10 * time.Second,
-			TLSClientConfig:     trap.TLS,
-			DisableKeepAlives:   true,
-			MaxIdleConns:        1,
-			MaxIdleConnsPerHost: -1,
-			DisableCompression:  false,
-		}
-	case trap.URL.Scheme == "http":
-		client.HTTPClient.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:       10 * time.Second,
-				KeepAlive:     3 * time.Second,
-				FallbackDelay: -1 * time.Millisecond,
-			}).DialContext,
-			DisableKeepAlives:   true,
-			MaxIdleConns:        1,
-			MaxIdleConnsPerHost: -1,
-			DisableCompression:  false,
-		}
-	case trap.IsSocket:
-		m.Log.Printf("using socket transport\n")
-		client.HTTPClient.Transport = trap.SockTransport
-	default:
-		return nil, fmt.Errorf("unknown scheme (%s), skipping submission", trap.URL.Scheme)
-	}
+	client.HTTPClient = httpClient
 	client.RetryWaitMin = 1 * time.Second
 	client.RetryWaitMax = 5 * time.Second
 	client.RetryMax = 3
@@ -205,7 +496,7 @@ func (m *CirconusMetrics) trapCall(payload []byte) (*trapResult, error) {
 		if lastHTTPError != nil {
 			return nil, fmt.Errorf("submitting: %w previous: %s attempts: %d", err, lastHTTPError, attempts)
 		}
-		if attempts == client.RetryMax {
+		if attempts == client.RetryMax && ctx.Err() == nil {
 			if err = m.check.RefreshTrap(); err != nil {
 				return nil, fmt.Errorf("refreshing trap: %w", err)
 			}
@@ -219,7 +510,15 @@ func (m *CirconusMetrics) trapCall(payload []byte) (*trapResult, error) {
 	// circonus-agent when metrics accepted
 	if resp.StatusCode == http.StatusNoContent {
 		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		return &trapResult{Stats: 0, Filtered: 0, Error: "agent", Duration: dur}, nil
+		return &SubmitResult{
+			Stats:        0,
+			Filtered:     0,
+			Error:        "agent",
+			Duration:     dur,
+			Attempts:     attempts + 1,
+			StatusCode:   resp.StatusCode,
+			PayloadBytes: len(data),
+		}, nil
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
@@ -227,15 +526,28 @@ func (m *CirconusMetrics) trapCall(payload []byte) (*trapResult, error) {
 		return nil, fmt.Errorf("error reading body: %w", err)
 	}
 
+	// broker or agent does not accept compressed payloads, fall back to
+	// sending them uncompressed (for this and all subsequent submissions)
+	if encoding != "" && (resp.StatusCode == http.StatusUnsupportedMediaType || resp.StatusCode == http.StatusBadRequest) {
+		m.Log.Printf("compressed (%s) payload rejected: %d (%s), disabling compression", encoding, resp.StatusCode, string(body))
+		m.trapcm.Lock()
+		m.trapCompressionOff = true
+		m.trapcm.Unlock()
+		return m.trapCall(ctx, payload)
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad response code: %d (%s)", resp.StatusCode, string(body))
+		return nil, &statusError{code: resp.StatusCode, body: string(body)}
 	}
 
-	var result trapResult
+	var result SubmitResult
 	if err := json.Unmarshal(body, &result); err != nil {
 		return nil, fmt.Errorf("error parsing body: %w (%s)", err, body)
 	}
 
 	result.Duration = dur
+	result.Attempts = attempts + 1
+	result.StatusCode = resp.StatusCode
+	result.PayloadBytes = len(data)
 	return &result, nil
 }
@@ -5,10 +5,18 @@
 package circonusgometrics
 
 import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -45,7 +53,9 @@ func TestSubmit(t *testing.T) {
 	// 	"_type":  "n",
 	// 	"_value": 1,
 	// }
-	cm.submit(output, newMetrics)
+	if _, err := cm.submit(context.Background(), output, newMetrics); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
 }
 
 func TestTrapCall(t *testing.T) {
@@ -78,7 +88,7 @@ func TestTrapCall(t *testing.T) {
 		t.Fatalf("unexpected error (%s)", err)
 	}
 
-	result, err := cm.trapCall(str)
+	result, err := cm.trapCall(context.Background(), str)
 	if err != nil {
 		t.Fatalf("unexpected error (%s)", err)
 	}
@@ -86,4 +96,409 @@ func TestTrapCall(t *testing.T) {
 	if result.Stats != 1 {
 		t.Fatalf("Expected 1, got %#v", result)
 	}
+	if result.Attempts != 1 {
+		t.Fatalf("Expected 1 attempt, got %#v", result)
+	}
+	if result.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %#v", result)
+	}
+	if result.PayloadBytes != len(str) {
+		t.Fatalf("Expected %d payload bytes, got %#v", len(str), result)
+	}
+
+	t.Log("canceled context")
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := cm.trapCall(ctx, str); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func TestTrapHTTPClient(t *testing.T) {
+	t.Log("Testing submit.trapHTTPClient")
+
+	var conns uint64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		fmt.Fprintln(w, `{"stats":1}`)
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddUint64(&conns, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	cfg := &Config{Interval: "0"}
+	cfg.CheckManager.Check.SubmissionURL = server.URL
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	payload := []byte(`{"foo":{"_type":"n","_value":1}}`)
+
+	for i := 0; i < 3; i++ {
+		if _, err := cm.trapCall(context.Background(), payload); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+	}
+
+	if n := atomic.LoadUint64(&conns); n != 1 {
+		t.Fatalf("expected 1 connection, got %d", n)
+	}
+
+	client := cm.trapClient
+
+	t.Log("reset trap")
+	{
+		if err := cm.check.ResetTrap(); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if _, err := cm.trapCall(context.Background(), payload); err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		if cm.trapClient == client {
+			t.Fatal("expected new client after trap reset")
+		}
+	}
+
+	t.Log("keep-alives disabled")
+	{
+		atomic.StoreUint64(&conns, 0)
+
+		cfg := &Config{Interval: "0", TrapMaxIdleConns: "0"}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if _, err := cm.trapCall(context.Background(), payload); err != nil {
+				t.Fatalf("unexpected error (%s)", err)
+			}
+		}
+
+		if n := atomic.LoadUint64(&conns); n != 3 {
+			t.Fatalf("expected 3 connections, got %d", n)
+		}
+	}
+}
+
+type recordingSubmitter struct {
+	err     error
+	metrics []Metrics
+	sync.Mutex
+}
+
+func (rs *recordingSubmitter) Submit(ctx context.Context, metrics Metrics) (*SubmitResult, error) {
+	rs.Lock()
+	defer rs.Unlock()
+	if rs.err != nil {
+		return nil, rs.err
+	}
+	rs.metrics = append(rs.metrics, metrics)
+	return &SubmitResult{Stats: uint64(len(metrics))}, nil
+}
+
+func TestSubmitter(t *testing.T) {
+	t.Log("Testing submit.Submitter")
+
+	rs := &recordingSubmitter{}
+
+	cfg := &Config{
+		Interval:  "0",
+		Submitter: rs,
+	}
+	cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	cm.Increment("foo")
+	cm.SetGauge("bar", 1)
+
+	result, err := cm.FlushContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if result.Stats != 2 {
+		t.Fatalf("expected 2 stats, got %#v", result)
+	}
+	if len(rs.metrics) != 1 {
+		t.Fatalf("expected 1 submission, got %d", len(rs.metrics))
+	}
+	if _, ok := rs.metrics[0]["foo"]; !ok {
+		t.Fatalf("expected foo in %v", rs.metrics[0])
+	}
+
+	t.Log("submitter error")
+	{
+		rs.err = fmt.Errorf("unavailable")
+		cm.Increment("foo")
+		if _, err := cm.FlushContext(context.Background()); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func TestSubmitterWithoutCheck(t *testing.T) {
+	t.Log("Testing submit.Submitter without a check manager")
+
+	rs := &recordingSubmitter{}
+
+	// no submission url or api token, a check manager could not be created
+	cfg := &Config{
+		Interval:  "0",
+		Submitter: rs,
+	}
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if cm.check != nil {
+		t.Fatal("expected no check manager")
+	}
+	if !cm.Ready() {
+		t.Fatal("expected ready")
+	}
+
+	cm.Increment("foo")
+	if cm.SetMetricTags("foo", []string{"a:b"}) {
+		t.Fatal("expected metric tags not to be set")
+	}
+
+	result, err := cm.FlushContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if result.Stats != 1 {
+		t.Fatalf("expected 1 stat, got %#v", result)
+	}
+
+	cm.Increment("foo")
+	if err := cm.Close(context.Background()); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if len(rs.metrics) != 2 {
+		t.Fatalf("expected 2 submissions, got %d", len(rs.metrics))
+	}
+}
+
+func TestTrapCallCompression(t *testing.T) {
+	t.Log("Testing submit.trapCall compression")
+
+	payload := []byte(`{"foo":{"_type":"n","_value":1}}`)
+
+	for _, encoding := range []string{compressionGzip, compressionDeflate} {
+		t.Logf("%s accepted", encoding)
+		{
+			var received []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var rdr io.ReadCloser
+				var err error
+				switch r.Header.Get("Content-Encoding") {
+				case compressionGzip:
+					rdr, err = gzip.NewReader(r.Body)
+				case compressionDeflate:
+					rdr, err = zlib.NewReader(r.Body)
+				default:
+					err = fmt.Errorf("unexpected encoding %q", r.Header.Get("Content-Encoding"))
+				}
+				if err != nil {
+					w.WriteHeader(415)
+					return
+				}
+				received, _ = ioutil.ReadAll(rdr)
+				w.WriteHeader(200)
+				fmt.Fprintln(w, `{"stats":1}`)
+			}))
+
+			cfg := &Config{Interval: "0", TrapCompression: encoding, TrapCompressionLevel: "9"}
+			cfg.CheckManager.Check.SubmissionURL = server.URL
+
+			cm, err := NewCirconusMetrics(cfg)
+			if err != nil {
+				t.Fatalf("unexpected error (%s)", err)
+			}
+
+			result, err := cm.trapCall(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("unexpected error (%s)", err)
+			}
+			if result.Stats != 1 {
+				t.Fatalf("expected 1, got %#v", result)
+			}
+			if string(received) != string(payload) {
+				t.Fatalf("expected %s, got %s", payload, received)
+			}
+			server.Close()
+		}
+	}
+
+	t.Log("compression rejected, fall back to uncompressed")
+	{
+		var compressed, uncompressed uint64
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Content-Encoding") != "" {
+				atomic.AddUint64(&compressed, 1)
+				w.WriteHeader(415)
+				fmt.Fprintln(w, "unsupported media type")
+				return
+			}
+			atomic.AddUint64(&uncompressed, 1)
+			w.WriteHeader(200)
+			fmt.Fprintln(w, `{"stats":1}`)
+		}))
+		defer server.Close()
+
+		cfg := &Config{Interval: "0", TrapCompression: compressionGzip}
+		cfg.CheckManager.Check.SubmissionURL = server.URL
+
+		cm, err := NewCirconusMetrics(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+
+		for i := 0; i < 2; i++ {
+			result, err := cm.trapCall(context.Background(), payload)
+			if err != nil {
+				t.Fatalf("unexpected error (%s)", err)
+			}
+			if result.Stats != 1 {
+				t.Fatalf("expected 1, got %#v", result)
+			}
+		}
+
+		if n := atomic.LoadUint64(&compressed); n != 1 {
+			t.Fatalf("expected 1 compressed request, got %d", n)
+		}
+		if n := atomic.LoadUint64(&uncompressed); n != 2 {
+			t.Fatalf("expected 2 uncompressed requests, got %d", n)
+		}
+	}
+
+	t.Log("invalid settings")
+	{
+		cfg := &Config{Interval: "0", TrapCompression: "br"}
+		cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+		if _, err := NewCirconusMetrics(cfg); err == nil {
+			t.Fatal("expected error")
+		}
+
+		cfg = &Config{Interval: "0", TrapCompression: compressionGzip, TrapCompressionLevel: "10"}
+		cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+		if _, err := NewCirconusMetrics(cfg); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+}
+
+func TestSplitMetrics(t *testing.T) {
+	t.Log("Testing submit.splitMetrics")
+
+	cfg := &Config{Interval: "0"}
+	cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	output := Metrics{}
+	for i := 0; i < 5; i++ {
+		output[fmt.Sprintf("metric%d", i)] = Metric{Type: "L", Value: uint64(i)}
+	}
+
+	t.Log("no limits")
+	{
+		chunks := cm.splitMetrics(output)
+		if len(chunks) != 1 {
+			t.Fatalf("expected 1 chunk, got %d", len(chunks))
+		}
+	}
+
+	t.Log("max metrics")
+	{
+		cm.maxMetricsPerRequest = 2
+		chunks := cm.splitMetrics(output)
+		if len(chunks) != 3 {
+			t.Fatalf("expected 3 chunks, got %d", len(chunks))
+		}
+		cm.maxMetricsPerRequest = 0
+	}
+
+	t.Log("max bytes")
+	{
+		data, err := json.Marshal(Metrics{"metric0": output["metric0"]})
+		if err != nil {
+			t.Fatalf("unexpected error (%s)", err)
+		}
+		cm.maxBytesPerRequest = len(data) + 1
+		chunks := cm.splitMetrics(output)
+		if len(chunks) != 5 {
+			t.Fatalf("expected 5 chunks, got %d", len(chunks))
+		}
+		for _, chunk := range chunks {
+			data, err := json.Marshal(chunk)
+			if err != nil {
+				t.Fatalf("unexpected error (%s)", err)
+			}
+			if len(data) > cm.maxBytesPerRequest {
+				t.Fatalf("chunk size %d exceeds %d", len(data), cm.maxBytesPerRequest)
+			}
+		}
+		cm.maxBytesPerRequest = 1
+		chunks = cm.splitMetrics(output)
+		if len(chunks) != 5 {
+			t.Fatalf("expected 5 chunks (oversize metrics sent alone), got %d", len(chunks))
+		}
+		cm.maxBytesPerRequest = 0
+	}
+}
+
+func TestSubmitSplit(t *testing.T) {
+	t.Log("Testing submit.submit split requests")
+
+	rs := &recordingSubmitter{}
+
+	cfg := &Config{
+		Interval:             "0",
+		Submitter:            rs,
+		MaxMetricsPerRequest: "2",
+		SubmitConcurrency:    "2",
+	}
+	cfg.CheckManager.Check.SubmissionURL = "http://127.0.0.1:56104/blah/blah"
+
+	cm, err := NewCirconusMetrics(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		cm.Increment(fmt.Sprintf("metric%d", i))
+	}
+
+	result, err := cm.FlushContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+	if result.Stats != 5 {
+		t.Fatalf("expected 5 stats, got %#v", result)
+	}
+	if result.Requests != 3 {
+		t.Fatalf("expected 3 requests, got %#v", result)
+	}
+	if len(rs.metrics) != 3 {
+		t.Fatalf("expected 3 submissions, got %d", len(rs.metrics))
+	}
 }
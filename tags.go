@@ -44,6 +44,9 @@ type Tags []Tag
 // Note: does not work with checks using metric_filters (the default) use metric
 // `*WithTags` helper methods or manual manage stream tags in metric names.
 func (m *CirconusMetrics) SetMetricTags(name string, tags []string) bool {
+	if m.check == nil {
+		return false
+	}
 	return m.check.AddMetricTags(name, tags, false)
 }
 
@@ -51,6 +54,9 @@ func (m *CirconusMetrics) SetMetricTags(name string, tags []string) bool {
 // Note: does not work with checks using metric_filters (the default) use metric
 // `*WithTags` helper methods or manual manage stream tags in metric names.
 func (m *CirconusMetrics) AddMetricTags(name string, tags []string) bool {
+	if m.check == nil {
+		return false
+	}
 	return m.check.AddMetricTags(name, tags, true)
 }
 
@@ -4,8 +4,68 @@
 
 package circonusgometrics
 
+import "sync/atomic"
+
 // A Text metric is an arbitrary string
-//
+type Text struct {
+	value   atomic.Value // string
+	touched uint32       // atomic, text updated since last flush
+	name    string
+}
+
+// NewText returns a text metric instance, the stream tagged metric
+// name is resolved once and updates to the text do not take a lock.
+func (m *CirconusMetrics) NewText(metric string, tags Tags) *Text {
+	name := m.MetricNameWithStreamTags(metric, tags)
+
+	m.tm.Lock()
+	defer m.tm.Unlock()
+
+	if m.textHandles == nil {
+		m.textHandles = make(map[string]*Text)
+	}
+
+	if t, ok := m.textHandles[name]; ok {
+		return t
+	}
+
+	t := &Text{name: name}
+	m.textHandles[name] = t
+
+	return t
+}
+
+// Name returns the name from a text instance
+func (t *Text) Name() string {
+	return t.name
+}
+
+// Set sets a text instance to a value
+func (t *Text) Set(val string) {
+	t.value.Store(val)
+	atomic.StoreUint32(&t.touched, 1)
+}
+
+// Value returns the current value of a text instance
+func (t *Text) Value() string {
+	v, _ := t.value.Load().(string)
+	return v
+}
+
+// snap returns the value of the text and whether it has been updated,
+// clearing the updated flag if reset is true
+func (t *Text) snap(reset bool) (string, bool) {
+	if reset {
+		if atomic.SwapUint32(&t.touched, 0) == 0 {
+			return "", false
+		}
+		return t.Value(), true
+	}
+	if atomic.LoadUint32(&t.touched) == 0 {
+		return "", false
+	}
+	return t.Value(), true
+}
 
 // SetTextWithTags sets a text metric with tags
 func (m *CirconusMetrics) SetTextWithTags(metric string, tags Tags, val string) {
@@ -39,6 +99,7 @@ func (m *CirconusMetrics) RemoveText(metric string) {
 	m.tm.Lock()
 	defer m.tm.Unlock()
 	delete(m.text, metric)
+	delete(m.textHandles, metric)
 }
 
 // SetTextFuncWithTags sets a text metric with tags to a function [called at flush interval]
@@ -256,3 +256,56 @@ func TestRemoveTextFuncWithTags(t *testing.T) {
 		t.Fatalf("expected nil got (%v)", val())
 	}
 }
+
+func TestNewText(t *testing.T) {
+	t.Log("Testing text.NewText")
+
+	cm := &CirconusMetrics{text: make(map[string]string), resetText: true}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("foo", tags)
+
+	txt := cm.NewText("foo", tags)
+	if txt.Name() != streamTagMetricName {
+		t.Fatalf("expected %s, got %s", streamTagMetricName, txt.Name())
+	}
+	if txt2 := cm.NewText("foo", tags); txt2 != txt {
+		t.Fatal("expected same text instance")
+	}
+
+	txt.Set("bar")
+
+	text := cm.snapText()
+	if text[streamTagMetricName] != "bar" {
+		t.Fatalf("expected bar, got %v", text[streamTagMetricName])
+	}
+
+	t.Log("reset")
+	{
+		text := cm.snapText()
+		if _, ok := text[streamTagMetricName]; ok {
+			t.Fatalf("expected text to be reset, got %v", text)
+		}
+	}
+
+	t.Log("no reset")
+	{
+		cm.resetText = false
+		txt.Set("baz")
+		for i := 0; i < 2; i++ {
+			text := cm.snapText()
+			if text[streamTagMetricName] != "baz" {
+				t.Fatalf("expected baz, got %v", text[streamTagMetricName])
+			}
+		}
+	}
+
+	t.Log("remove")
+	{
+		cm.RemoveText(streamTagMetricName)
+		text := cm.snapText()
+		if _, ok := text[streamTagMetricName]; ok {
+			t.Fatalf("expected text to be removed, got %v", text)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	timerResultTagCategory = "result"
+	timerResultSuccess     = "success"
+	timerResultError       = "error"
+)
+
+// A Timer records the time elapsed between StartTimer and Stop to a histogram.
+type Timer struct {
+	m       *CirconusMetrics
+	name    string
+	start   time.Time
+	stopped uint32 // atomic
+}
+
+// StartTimer starts a timer for a histogram metric with tags, the elapsed
+// time is recorded when the timer is stopped.
+func (m *CirconusMetrics) StartTimer(metric string, tags Tags) *Timer {
+	return &Timer{
+		m:     m,
+		name:  m.MetricNameWithStreamTags(metric, tags),
+		start: time.Now(),
+	}
+}
+
+// Stop records the time elapsed since the timer was started and returns it.
+// Only the first call to Stop records a duration.
+func (t *Timer) Stop() time.Duration {
+	elapsed := time.Since(t.start)
+	if atomic.CompareAndSwapUint32(&t.stopped, 0, 1) {
+		t.m.RecordDuration(t.name, elapsed)
+	}
+	return elapsed
+}
+
+// Time calls fn and records how long it took to a histogram metric with tags
+func (m *CirconusMetrics) Time(metric string, tags Tags, fn func()) {
+	start := time.Now()
+	fn()
+	m.RecordDurationWithTags(metric, tags, time.Since(start))
+}
+
+// TimeErr calls fn and records how long it took to a histogram metric with
+// tags, returning the error from fn. Successful and failed calls are recorded
+// to separate series, tagged result:success and result:error respectively.
+func (m *CirconusMetrics) TimeErr(metric string, tags Tags, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	elapsed := time.Since(start)
+
+	result := timerResultSuccess
+	if err != nil {
+		result = timerResultError
+	}
+
+	// copy, the caller's tags must not be modified
+	resultTags := make(Tags, 0, len(tags)+1)
+	resultTags = append(resultTags, tags...)
+	resultTags = append(resultTags, Tag{Category: timerResultTagCategory, Value: result})
+
+	m.RecordDurationWithTags(metric, resultTags, elapsed)
+
+	return err
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Circonus, Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package circonusgometrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStartTimer(t *testing.T) {
+	t.Log("Testing timer.StartTimer")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+
+	tags := Tags{{"foo", "bar"}}
+	streamTagMetricName := cm.MetricNameWithStreamTags("foo", tags)
+
+	timer := cm.StartTimer("foo", tags)
+	time.Sleep(10 * time.Millisecond)
+	elapsed := timer.Stop()
+	if elapsed < 10*time.Millisecond {
+		t.Fatalf("expected >= 10ms, got %s", elapsed)
+	}
+
+	// only the first stop records
+	timer.Stop()
+
+	if c, err := cm.HistogramCount(streamTagMetricName); err != nil || c != 1 {
+		t.Fatalf("expected 1 sample, got %d (%v)", c, err)
+	}
+	if v, err := cm.HistogramMin(streamTagMetricName); err != nil || v < 0.009 {
+		t.Fatalf("expected >= 0.01s, got %v (%v)", v, err)
+	}
+}
+
+func TestTime(t *testing.T) {
+	t.Log("Testing timer.Time")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+
+	called := false
+	cm.Time("foo", nil, func() { called = true })
+	if !called {
+		t.Fatal("expected function to be called")
+	}
+
+	if c, err := cm.HistogramCount("foo"); err != nil || c != 1 {
+		t.Fatalf("expected 1 sample, got %d (%v)", c, err)
+	}
+}
+
+func TestTimeErr(t *testing.T) {
+	t.Log("Testing timer.TimeErr")
+
+	cm := &CirconusMetrics{histograms: make(map[string]*Histogram)}
+
+	tags := Tags{{"foo", "bar"}}
+	successName := cm.MetricNameWithStreamTags("foo", Tags{{"foo", "bar"}, {"result", "success"}})
+	errorName := cm.MetricNameWithStreamTags("foo", Tags{{"foo", "bar"}, {"result", "error"}})
+
+	if err := cm.TimeErr("foo", tags, func() error { return nil }); err != nil {
+		t.Fatalf("unexpected error (%s)", err)
+	}
+
+	expectedErr := errors.New("failed")
+	for i := 0; i < 2; i++ {
+		if err := cm.TimeErr("foo", tags, func() error { return expectedErr }); err != expectedErr {
+			t.Fatalf("expected %v, got %v", expectedErr, err)
+		}
+	}
+
+	if len(tags) != 1 {
+		t.Fatalf("expected tags not to be modified, got %v", tags)
+	}
+
+	if c, err := cm.HistogramCount(successName); err != nil || c != 1 {
+		t.Fatalf("expected 1 success sample, got %d (%v)", c, err)
+	}
+	if c, err := cm.HistogramCount(errorName); err != nil || c != 2 {
+		t.Fatalf("expected 2 error samples, got %d (%v)", c, err)
+	}
+}